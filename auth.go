@@ -0,0 +1,189 @@
+// Shared secret authentication between clients and server, both ways.
+//
+// The server sends a challenge with a random nonce, the client answers with
+// HMAC-SHA256(secret, nonce) and a nonce of it's own, and the server sends
+// welcome, with the HMAC of the client's nonce, if it matches. So a client
+// never talks to a server (or peer) which doesn't know the secret either.
+// The proofs are prefixed by who makes them, so neither side can be used to
+// answer the other's challenge. The secret never crosses the network.
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	MSG_CHALLENGE = "challenge"
+	MSG_AUTH      = "auth"
+	MSG_WELCOME   = "welcome"
+
+	AUTH_CLIENT = "client " // Prefix of the nonce in the client's proof
+	AUTH_SERVER = "server " // and in the server's
+
+	DEFAULT_SECRET_FILE = ".config/loftus/secret" // In $HOME
+	HANDSHAKE_SECS      = 10
+)
+
+// Read the shared secret. Empty if there isn't one, which disables authentication.
+func readSecret(path string) (string, error) {
+
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(path)
+	if err == nil && info.Mode().Perm()&0077 != 0 {
+		log.Println("Warning:", path, "is readable by other users. chmod 600 it.")
+	}
+
+	return strings.TrimSpace(string(content)), nil
+}
+
+// Default location of the secret file
+func defaultSecretFile() string {
+	return filepath.Join(os.Getenv("HOME"), DEFAULT_SECRET_FILE)
+}
+
+// Proof that we know secret, for this nonce. prefix is AUTH_CLIENT or AUTH_SERVER.
+func authMac(secret string, prefix string, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(prefix + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// A random nonce, in hex
+func newNonce() (string, error) {
+	nonceBytes := make([]byte, 32)
+	_, err := rand.Read(nonceBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(nonceBytes), nil
+}
+
+// Server side. Challenge the client, check it's answer, and prove ourselves.
+// With an empty secret every client is welcome.
+func serverHandshake(conn net.Conn, bufRead *bufio.Reader, secret string) error {
+
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_SECS * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+
+	challenge := NewMessage(MSG_CHALLENGE, "", "", "")
+	challenge.Nonce = nonce
+	_, err = conn.Write([]byte(challenge.Encode()))
+	if err != nil {
+		return err
+	}
+
+	line, err := bufRead.ReadString('\n')
+	if err != nil {
+		return err
+	}
+
+	answer, err := decodeMessage(line)
+	if err != nil {
+		return err
+	}
+	if answer.Type != MSG_AUTH {
+		return errors.New("expected auth message, got " + answer.Type)
+	}
+
+	expected := authMac(secret, AUTH_CLIENT, challenge.Nonce)
+	if len(secret) != 0 && !hmac.Equal([]byte(answer.Mac), []byte(expected)) {
+		return errors.New("wrong secret from sender " + answer.Sender)
+	}
+
+	welcome := NewMessage(MSG_WELCOME, "", "", "")
+	if len(secret) != 0 {
+		welcome.Mac = authMac(secret, AUTH_SERVER, answer.Nonce)
+	}
+	_, err = conn.Write([]byte(welcome.Encode()))
+	return err
+}
+
+// Client side. Answer the server's challenge, and wait to be welcomed.
+// With a secret, the server must prove it knows it too.
+func clientHandshake(conn net.Conn, bufRead *bufio.Reader, secret string, sender string) error {
+
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_SECS * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	line, err := bufRead.ReadString('\n')
+	if err != nil {
+		return err
+	}
+
+	challenge, err := decodeMessage(line)
+	if err != nil {
+		return err
+	}
+	if challenge.Type != MSG_CHALLENGE {
+		return errors.New("expected challenge from server, got " + challenge.Type)
+	}
+
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+
+	answer := NewMessage(MSG_AUTH, "", sender, "")
+	answer.Mac = authMac(secret, AUTH_CLIENT, challenge.Nonce)
+	answer.Nonce = nonce
+	_, err = conn.Write([]byte(answer.Encode()))
+	if err != nil {
+		return err
+	}
+
+	// The server closes the connection if it doesn't like our answer
+	line, err = bufRead.ReadString('\n')
+	if err != nil {
+		return errors.New("server rejected us, check the secret matches. " + err.Error())
+	}
+
+	welcome, err := decodeMessage(line)
+	if err != nil {
+		return err
+	}
+	if welcome.Type != MSG_WELCOME {
+		return errors.New("expected welcome from server, got " + welcome.Type)
+	}
+
+	expected := authMac(secret, AUTH_SERVER, nonce)
+	if len(secret) != 0 && !hmac.Equal([]byte(welcome.Mac), []byte(expected)) {
+		return errors.New("server didn't prove it knows the secret. It may be an impostor, or an older loftus.")
+	}
+	return nil
+}
+
+// The shared secret from --secret-file. Empty, with a warning, if there isn't one.
+func (self *Config) loadSecret() string {
+
+	secret, err := readSecret(self.secretFile)
+	if err != nil {
+		log.Fatal("Error reading secret: ", err)
+	}
+	if len(secret) == 0 {
+		log.Println("Warning: No secret in", self.secretFile, "so the sync server is open to anyone.")
+	}
+	return secret
+}
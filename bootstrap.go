@@ -0,0 +1,433 @@
+// Setting up a new machine
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	SSH_HOST_ALIAS = "loftus_server"
+	SSH_KEY_NAME   = "id_ed25519.loftus"
+	DEFAULT_USER   = "loftus"
+	DEFAULT_REMOTE = "~/repo.git"
+
+	SYSTEMD_UNIT = `[Unit]
+Description=Loftus: Git/inotify personal backup
+After=network-online.target
+
+[Service]
+ExecStart=%s
+Restart=on-failure
+RestartSec=5
+
+[Install]
+WantedBy=default.target
+`
+)
+
+// A named part of a longer command, so we can say which part failed
+type step struct {
+	name string
+	run  func() error
+}
+
+// Run steps in order, stopping at the first error
+func runSteps(steps []step) error {
+	for num, current := range steps {
+		log.Printf("Step %d of %d: %s\n", num+1, len(steps), current.name)
+		err := current.run()
+		if err != nil {
+			return fmt.Errorf("Step %d of %d, %s, failed: %s", num+1, len(steps), current.name, err)
+		}
+	}
+	return nil
+}
+
+// Run an external command, making an error which includes it's output
+func runExternal(external External, dir string, cmd string, args ...string) error {
+	output, err := external.Exec(dir, cmd, args...)
+	if err != nil {
+		return errors.New(err.Error() + "\n" + strings.TrimSpace(string(output)+errorOutput(err)))
+	}
+	return nil
+}
+
+// loftus join [user@]host[:port]
+//
+// Set up this machine as a client: ssh key, ssh config, clone the repo,
+// check everything works, and write a systemd user unit to run us.
+func joinCmd(config *Config) error {
+
+	if len(config.args) != 1 {
+		return errors.New("Usage: loftus join [user@]host[:port] [--address=host:port] [--install-key]")
+	}
+
+	user, host, port := splitServer(config.args[0])
+	home := os.Getenv("HOME")
+	keyPath := filepath.Join(home, ".ssh", SSH_KEY_NAME)
+	remote := "ssh://" + SSH_HOST_ALIAS + "/" + strings.TrimPrefix(config.remoteRepo, "/")
+	if strings.HasPrefix(config.remoteRepo, "/") {
+		remote = "ssh://" + SSH_HOST_ALIAS + config.remoteRepo
+	}
+	external := &RealExternal{}
+
+	steps := []step{
+		{"generate ssh key", func() error {
+			return makeKey(external, keyPath, config.hostName)
+		}},
+		{"install public key on server", func() error {
+			return installKey(external, keyPath, user, host, port, config.isInstallKey)
+		}},
+		{"write ssh config", func() error {
+			return writeSshConfig(filepath.Join(home, ".ssh", "config"), user, host, port, keyPath)
+		}},
+		{"check server access", func() error {
+			err := runExternal(external, "", "git", "ls-remote", remote)
+			if err != nil {
+				return errors.New("Cannot read " + remote + ". Is the public key installed? " + err.Error())
+			}
+			return nil
+		}},
+		{"clone repository", func() error {
+			return cloneRepo(external, remote, config.syncDir)
+		}},
+		{"check everything", func() error {
+			return checkAll(config.syncDir, NewGitBackend(config, external), config)
+		}},
+		{"write systemd unit", func() error {
+			return writeSystemdUnit(home, "loftus", clientArgs(config))
+		}},
+	}
+
+	return runSteps(steps)
+}
+
+// Flags for the client we run from systemd, so it connects the way join did
+func clientArgs(config *Config) string {
+
+	args := []string{"--dir=" + config.syncDir}
+	if len(config.serverAddr) != 0 {
+		args = append(args, "--address="+config.serverAddr)
+	}
+	if defaultHost, _ := os.Hostname(); config.hostName != defaultHost {
+		args = append(args, "--host="+config.hostName)
+	}
+	if config.secretFile != defaultSecretFile() {
+		args = append(args, "--secret-file="+config.secretFile)
+	}
+	if config.isTls {
+		args = append(args, "--tls")
+	}
+	if len(config.tlsCa) != 0 {
+		args = append(args, "--tls-ca="+config.tlsCa)
+	}
+	if config.isMdns {
+		args = append(args, "--mdns")
+	}
+
+	// systemd splits ExecStart on spaces, unless quoted
+	for num, arg := range args {
+		if strings.ContainsAny(arg, " \t\"\\") {
+			args[num] = strconv.Quote(arg)
+		}
+	}
+	return strings.Join(args, " ")
+}
+
+// Split [user@]host[:port]. User defaults to 'loftus', port is empty if not given.
+func splitServer(server string) (user string, host string, port string) {
+
+	user = DEFAULT_USER
+	if strings.Contains(server, "@") {
+		serverParts := strings.SplitN(server, "@", 2)
+		user, server = serverParts[0], serverParts[1]
+	}
+
+	host = server
+	if strings.Contains(server, ":") {
+		serverParts := strings.SplitN(server, ":", 2)
+		host, port = serverParts[0], serverParts[1]
+	}
+
+	return user, host, port
+}
+
+// Run: ssh-keygen, unless we already have a key
+func makeKey(external External, keyPath string, hostName string) error {
+
+	_, err := os.Stat(keyPath)
+	if err == nil {
+		log.Println("Using existing key", keyPath)
+		return nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(keyPath), 0700)
+	if err != nil {
+		return err
+	}
+
+	// No passphrase, we run unattended
+	return runExternal(external, "",
+		"ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "loftus@"+hostName, "-f", keyPath)
+}
+
+// Print the public key, and install it with ssh-copy-id if asked to
+func installKey(external External, keyPath string, user string, host string, port string, isInstall bool) error {
+
+	pubKey, err := os.ReadFile(keyPath + ".pub")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Public key:\n\n" + string(pubKey))
+
+	if !isInstall {
+		fmt.Println("Add it to ~" + user + "/.ssh/authorized_keys on " + host +
+			", or re-run with --install-key if you can log in to " + user + "@" + host + " with a password.")
+		return nil
+	}
+
+	args := []string{"-i", keyPath + ".pub"}
+	if len(port) != 0 {
+		args = append(args, "-p", port)
+	}
+	args = append(args, user+"@"+host)
+	return runExternal(external, "", "ssh-copy-id", args...)
+}
+
+// Add a 'Host loftus_server' stanza to ~/.ssh/config, unless there is one
+func writeSshConfig(configPath string, user string, host string, port string, keyPath string) error {
+
+	existing, err := os.ReadFile(configPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, line := range strings.Split(string(existing), "\n") {
+		if strings.TrimSpace(line) == "Host "+SSH_HOST_ALIAS {
+			log.Println(configPath, "already has", SSH_HOST_ALIAS, "- leaving it alone")
+			return nil
+		}
+	}
+
+	stanza := "\nHost " + SSH_HOST_ALIAS + "\n" +
+		"    HostName " + host + "\n" +
+		"    User " + user + "\n"
+	if len(port) != 0 {
+		stanza += "    Port " + port + "\n"
+	}
+	stanza += "    IdentityFile " + keyPath + "\n" +
+		"    IdentitiesOnly yes\n"
+
+	out, err := os.OpenFile(configPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = out.WriteString(stanza)
+	closeErr := out.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Run: git clone remote syncDir, unless syncDir is already a repo
+func cloneRepo(external External, remote string, syncDir string) error {
+
+	_, err := os.Stat(filepath.Join(syncDir, ".git"))
+	if err == nil {
+		log.Println(syncDir, "is already a git repository")
+		return nil
+	}
+
+	entries, err := os.ReadDir(syncDir)
+	if err == nil && len(entries) != 0 {
+		return errors.New(syncDir + " exists and is not empty. Move it, or choose another with --dir")
+	}
+
+	return runExternal(external, "", "git", "clone", remote, syncDir)
+}
+
+// Write ~/.config/systemd/user/<name>.service, which runs us with args
+func writeSystemdUnit(home string, name string, args string) error {
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	unitPath := filepath.Join(home, ".config", "systemd", "user", name+".service")
+	err = os.MkdirAll(filepath.Dir(unitPath), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(unitPath, []byte(fmt.Sprintf(SYSTEMD_UNIT, executable+" "+args)), 0644)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Wrote " + unitPath + ". Start it now, and on every login, with:\n\n" +
+		"    systemctl --user enable --now " + name + "\n")
+	return nil
+}
+
+// loftus server-init --dir=<bare repo> --address=<host:port>
+//
+// Set up this machine as the server, in the current user's account: a bare
+// repository which tells the loftus server (via --socket) about every push, ssh permissions,
+// and a systemd user unit for the loftus server.
+func serverInitCmd(config *Config) error {
+
+	if len(config.serverAddr) == 0 {
+		return errors.New("Usage: loftus server-init --address=host:port [--dir=" + DEFAULT_REMOTE + "]")
+	}
+
+	home := os.Getenv("HOME")
+	repoDir := config.syncDir
+	if repoDir == home+DEFAULT_SYNC_DIR {
+		// Not given, the client default doesn't make sense here
+		repoDir = filepath.Join(home, strings.TrimPrefix(DEFAULT_REMOTE, "~/"))
+	}
+
+	external := &RealExternal{}
+	hookPath := filepath.Join(repoDir, "hooks", "post-receive")
+
+	steps := []step{
+		{"create bare repository", func() error {
+			return initBareRepo(external, repoDir)
+		}},
+		{"configure repository", func() error {
+			return configureBareRepo(external, repoDir)
+		}},
+		{"install post-receive hook", func() error {
+			return writeHook(hookPath, config.socketPath)
+		}},
+		{"fix ssh permissions", func() error {
+			return fixSshPermissions(filepath.Join(home, ".ssh"))
+		}},
+		{"verify", func() error {
+			return verifyServer(external, repoDir, hookPath)
+		}},
+		{"write systemd unit", func() error {
+			return writeSystemdUnit(home, "loftus-server",
+				"--server --address="+config.serverAddr+" --socket="+config.socketPath)
+		}},
+	}
+
+	err := runSteps(steps)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Clients can now join with: loftus join " + os.Getenv("USER") + "@<this host>" +
+		" --remote-repo=" + repoDir + " --address=" + config.serverAddr)
+	return nil
+}
+
+// Run: git init --bare, unless it's already a repository
+func initBareRepo(external External, repoDir string) error {
+
+	output, err := external.Exec(repoDir, "git", "rev-parse", "--is-bare-repository")
+	if err == nil && strings.TrimSpace(string(output)) == "true" {
+		log.Println(repoDir, "is already a bare repository")
+		return nil
+	}
+
+	err = runExternal(external, "", "git", "init", "--bare", repoDir)
+	if err != nil {
+		return err
+	}
+
+	// Clients merge origin/master
+	return runExternal(external, repoDir, "git", "symbolic-ref", "HEAD", "refs/heads/master")
+}
+
+// Refuse pushes which would lose history or objects. 'loftus compact' run
+// on the server is unaffected, because it doesn't push.
+func configureBareRepo(external External, repoDir string) error {
+
+	settings := [][]string{
+		{"receive.denyNonFastForwards", "true"},
+		{"receive.denyDeletes", "true"},
+		{"receive.fsckObjects", "true"},
+	}
+
+	for _, setting := range settings {
+		err := runExternal(external, repoDir, "git", "config", setting[0], setting[1])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write a post-receive hook which runs 'loftus notify'
+func writeHook(hookPath string, socketPath string) error {
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	hook := "#!/bin/sh\n" +
+		"# Installed by loftus server-init. Tells clients about every push.\n" +
+		"exec " + executable + " notify --socket=" + socketPath + "\n"
+
+	err = os.WriteFile(hookPath, []byte(hook), 0755)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(hookPath, 0755)
+}
+
+// ssh refuses keys if .ssh or authorized_keys are writable by others
+func fixSshPermissions(sshDir string) error {
+
+	err := os.MkdirAll(sshDir, 0700)
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(sshDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	keysPath := filepath.Join(sshDir, "authorized_keys")
+	keys, err := os.OpenFile(keysPath, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return err
+	}
+	keys.Close()
+	return os.Chmod(keysPath, 0600)
+}
+
+// Check the repository is bare, configured, and has an executable hook
+func verifyServer(external External, repoDir string, hookPath string) error {
+
+	output, err := external.Exec(repoDir, "git", "rev-parse", "--is-bare-repository")
+	if err != nil || strings.TrimSpace(string(output)) != "true" {
+		return errors.New(repoDir + " is not a bare git repository")
+	}
+
+	output, err = external.Exec(repoDir, "git", "config", "--get", "receive.denyNonFastForwards")
+	if err != nil || strings.TrimSpace(string(output)) != "true" {
+		return errors.New(repoDir + " allows non fast-forward pushes")
+	}
+
+	info, err := os.Stat(hookPath)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&0111 == 0 {
+		return errors.New(hookPath + " is not executable")
+	}
+
+	return nil
+}
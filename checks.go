@@ -2,6 +2,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"log"
 	"os"
@@ -11,23 +12,32 @@ import (
 // CheckEverything runs a series of checks on the environment, aborting if any errors
 func CheckEverything(external External, syncDir string, storage Storage, config *Config) {
 
-	abortOnErr := func(err error) {
-		if err == nil {
-			return
-		}
+	err := checkAll(syncDir, storage, config)
+	if err != nil {
 		log.Println(err)
 		external.Exec("", CMD_ALERT, err.Error())
 		os.Exit(1)
 	}
+}
+
+// Run the checks, returning the first error
+func checkAll(syncDir string, storage Storage, config *Config) error {
 
-	abortOnErr(checkDir(syncDir))
-	abortOnErr(storage.Check())
+	err := checkDir(syncDir)
+	if err != nil {
+		return err
+	}
+	err = storage.Check()
+	if err != nil {
+		return err
+	}
 	checkHelperScripts() // Information only, no errors
 
 	// Only check the connection if one is configured
 	if checkRemoteConfig(config) {
-		abortOnErr(checkRemoteConnection(config.serverAddr))
+		return checkRemoteConnection(config)
 	}
+	return nil
 }
 
 // Check sync directory is accessible.
@@ -78,6 +88,9 @@ func checkRemoteConfig(config *Config) bool {
 	}
 
 	msg := "No sync server (--address) defined. "
+	if config.isMdns {
+		msg += "We'll use one if we find it on the local network (mDNS), and share a secret or --tls-ca with it. "
+	}
 	msg += "Unless all your machines are on the same local network, "
 	msg += "you will need to specify --address=... for sync to work."
 	log.Println(msg)
@@ -86,16 +99,27 @@ func checkRemoteConfig(config *Config) bool {
 }
 
 // Can we see the remote server?
-func checkRemoteConnection(serverAddr string) error {
+func checkRemoteConnection(config *Config) error {
 
+	serverAddr := config.serverAddr
 	log.Println("Connecting to sync server at", serverAddr)
 
-	conn := getRemoteConnection(serverAddr, false)
-	if conn == nil {
-		return errors.New("Cannot connect to sync server: " + serverAddr)
+	var tlsConf *tls.Config
+	if config.isTls {
+		var err error
+		tlsConf, err = clientTlsConfig(config, serverAddr)
+		if err != nil {
+			return err
+		}
+	}
+
+	conn, _, err := getRemoteConnection(serverAddr, tlsConf, config.loadSecret(), "")
+	if err != nil {
+		return errors.New("Cannot connect to sync server. " + err.Error())
 	}
+	defer conn.Close()
 
-	err := tcpSend(conn, "Test\n")
+	err = tcpSend(conn, NewMessage(MSG_TEST, "", "", "").Encode())
 	if err != nil {
 		return errors.New("Cannot send data to remote server. " + err.Error())
 	}
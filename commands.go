@@ -0,0 +1,479 @@
+// One-shot commands, e.g. 'loftus restore .vimrc'
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Formats accepted by --at, in addition to durations such as '3h' or '2d'
+var WHEN_FORMATS = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// Run the command given on the command line, then exit
+func runCommand(config *Config) {
+
+	var err error
+
+	switch config.command {
+	case "restore":
+		err = restoreCmd(config)
+	case "history":
+		err = historyCmd(config)
+	case "diff":
+		err = diffCmd(config)
+	case "compact":
+		err = compactCmd(config)
+	case "snapshot":
+		err = snapshotCmd(config)
+	case "snapshots":
+		err = snapshotsCmd(config)
+	case "rollback":
+		err = rollbackCmd(config)
+	case "deploy":
+		err = deployCmd(config)
+	case "join":
+		err = joinCmd(config)
+	case "server-init":
+		err = serverInitCmd(config)
+	case "notify":
+		err = notifyCmd(config)
+	case "status":
+		err = statusCmd(config)
+	case "ctl":
+		err = ctlCmd(config)
+	case "peer-pipe":
+		err = peerPipeCmd(config)
+	default:
+		err = errors.New("Unknown command: " + config.command)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Build the storage backend for a command, checking it is usable
+func commandBackend(config *Config) (Storage, error) {
+
+	backend := NewGitBackend(config, &RealExternal{})
+	err := backend.Check()
+	if err != nil {
+		return nil, err
+	}
+	return backend, nil
+}
+
+// loftus restore <path> [--at=<time>|--commit=<id>]
+//
+// Write a previous version of a file back into the sync directory.
+// We don't touch storage directly: the running client notices the change
+// like any other edit, so the restore is itself recorded.
+func restoreCmd(config *Config) error {
+
+	if len(config.args) != 1 || (len(config.commit) != 0 && len(config.at) != 0) {
+		return errors.New("Usage: loftus restore <path> [--at=<time>|--commit=<id>]")
+	}
+
+	filename, err := repoPath(config.syncDir, config.args[0])
+	if err != nil {
+		return err
+	}
+
+	backend, err := commandBackend(config)
+	if err != nil {
+		return err
+	}
+
+	var content []byte
+	var mode os.FileMode
+
+	switch {
+	case len(config.commit) != 0:
+		content, mode, err = backend.FileAt(filename, config.commit)
+
+	case len(config.at) != 0:
+		var when time.Time
+		var rev string
+		when, err = parseWhen(config.at)
+		if err != nil {
+			return err
+		}
+		rev, err = backend.RevisionAt(when)
+		if err != nil {
+			return err
+		}
+		content, mode, err = backend.FileAt(filename, rev)
+
+	default:
+		content, mode, err = latestDifferent(backend, config.syncDir, filename)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = writeRestored(filepath.Join(config.syncDir, filename), content, mode)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Restored", filename)
+	return nil
+}
+
+// Put a stored version back at path, as FileAt returned it.
+// Symlinks are restored as symlinks, replacing whatever is there.
+func writeRestored(path string, content []byte, mode os.FileMode) error {
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	// Replace a symlink, instead of writing through it
+	info, err := os.Lstat(path)
+	if err == nil && (info.Mode()&os.ModeSymlink != 0 || mode&os.ModeSymlink != 0) {
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	if mode&os.ModeSymlink != 0 {
+		return os.Symlink(string(content), path)
+	}
+
+	err = os.WriteFile(path, content, mode.Perm())
+	if err != nil {
+		return err
+	}
+	return os.Chmod(path, mode.Perm())
+}
+
+// The most recent stored version of filename which is different from the
+// one in the sync directory. If filename was deleted that's the last
+// version before the delete.
+func latestDifferent(backend Storage, syncDir string, filename string) ([]byte, os.FileMode, error) {
+
+	// As FileAt would give it
+	current, _ := os.ReadFile(filepath.Join(syncDir, filename))
+	if target, err := os.Readlink(filepath.Join(syncDir, filename)); err == nil {
+		current = []byte(target)
+	}
+
+	revisions, err := backend.History(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for _, rev := range revisions {
+
+		content, mode, err := backend.FileAt(rev.Filename, rev.Id)
+		if err != nil {
+			// Most likely the revision which deleted it
+			continue
+		}
+
+		if !bytes.Equal(content, current) {
+			return content, mode, nil
+		}
+	}
+
+	return nil, 0, errors.New("No previous version of " + filename)
+}
+
+// loftus history [path]
+//
+// List every change to a file, or to anything, newest first.
+func historyCmd(config *Config) error {
+
+	if len(config.args) > 1 {
+		return errors.New("Usage: loftus history [path]")
+	}
+
+	var filename string
+	var err error
+	if len(config.args) == 1 {
+		filename, err = repoPath(config.syncDir, config.args[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	backend, err := commandBackend(config)
+	if err != nil {
+		return err
+	}
+
+	revisions, err := backend.History(filename)
+	if err != nil {
+		return err
+	}
+	if len(revisions) == 0 {
+		return errors.New("No history for " + filename)
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, rev := range revisions {
+
+		summary := rev.Summary
+		if len(filename) != 0 && rev.Filename != filename {
+			summary += " (as " + rev.Filename + ")"
+		}
+		for _, label := range rev.Snaps {
+			summary += " [snapshot " + label + "]"
+		}
+
+		// Commits not made by loftus don't record a host
+		origin := rev.Meta.Host
+		if len(origin) == 0 {
+			origin = rev.Author
+		}
+
+		fmt.Fprintf(out, "%s\t%s\t%s\t%s\n",
+			rev.When.Format("2006-01-02 15:04"), shortId(rev.Id), origin, summary)
+	}
+	return out.Flush()
+}
+
+// loftus diff <path> <when>
+//
+// Show what changed in a file since a time or commit.
+func diffCmd(config *Config) error {
+
+	if len(config.args) != 2 {
+		return errors.New("Usage: loftus diff <path> <time|commit>")
+	}
+
+	filename, err := repoPath(config.syncDir, config.args[0])
+	if err != nil {
+		return err
+	}
+
+	backend, err := commandBackend(config)
+	if err != nil {
+		return err
+	}
+
+	rev, err := resolveRevision(backend, config.args[1])
+	if err != nil {
+		return err
+	}
+
+	diff, err := backend.Diff(filename, rev)
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(diff)
+	return nil
+}
+
+// loftus notify [--socket=<path>]
+//
+// Run by the post-receive hook, in the server's bare repository. Reads the
+// hook's input, a line per updated ref, and sends an update message for
+// each to the server's local socket, so it can tell every client.
+func notifyCmd(config *Config) error {
+
+	conn, err := net.Dial("unix", config.socketPath)
+	if err != nil {
+		return errors.New("Cannot connect to loftus server on " + config.socketPath + ". " + err.Error())
+	}
+	defer conn.Close()
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	backend := NewGitBackend(&Config{syncDir: cwd}, &RealExternal{})
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+
+		// <old id> SP <new id> SP <ref>
+		lineParts := strings.Fields(scanner.Text())
+		if len(lineParts) != 3 {
+			continue
+		}
+
+		repoId, err := backend.RepoId()
+		if err != nil {
+			return err
+		}
+
+		msg := NewMessage(MSG_UPDATE, repoId, "", lineParts[1])
+		_, err = conn.Write([]byte(msg.Encode()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Revision identifier from either a time (see parseWhen) or a commit id.
+// Some short ids are times too, e.g. '4412d', so we refuse to guess.
+func resolveRevision(backend Storage, when string) (string, error) {
+
+	t, err := parseWhen(when)
+	if err != nil {
+		id, err := backend.RevisionId(when)
+		if err != nil {
+			return "", errors.New(when + " is neither a time (e.g. '2013-05-21 14:30' or '3h') nor a commit id")
+		}
+		return id, nil
+	}
+
+	if isHex(when) {
+		_, err = backend.RevisionId(when)
+		if err == nil {
+			return "", errors.New(when + " is both a commit id and a time. Give more of the commit id, " +
+				"or the time another way, e.g. in hours or as a date")
+		}
+	}
+	return backend.RevisionAt(t)
+}
+
+// Could it be an abbreviated commit id?
+func isHex(str string) bool {
+	_, err := hex.DecodeString(strings.Repeat("0", len(str)%2) + str)
+	return len(str) != 0 && err == nil
+}
+
+// Abbreviated revision id, for display
+func shortId(id string) string {
+	if len(id) > 7 {
+		return id[:7]
+	}
+	return id
+}
+
+// Convert a path given by the user to one relative to the sync directory.
+// Relative paths are relative to the current directory if we're inside
+// syncDir, otherwise to syncDir itself.
+func repoPath(syncDir string, path string) (string, error) {
+
+	syncDir, err := filepath.Abs(syncDir)
+	if err != nil {
+		return "", err
+	}
+
+	if !filepath.IsAbs(path) {
+		cwd, err := os.Getwd()
+		if err == nil && isInside(syncDir, cwd) {
+			path = filepath.Join(cwd, path)
+		} else {
+			path = filepath.Join(syncDir, path)
+		}
+	}
+
+	if !isInside(syncDir, path) {
+		return "", errors.New(path + " is not inside " + syncDir)
+	}
+
+	rel, err := filepath.Rel(syncDir, path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// Is path the same as or below dir? Both must be absolute.
+func isInside(dir string, path string) bool {
+	path = filepath.Clean(path)
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// Parse a time given by the user, either absolute or a duration ago.
+func parseWhen(when string) (time.Time, error) {
+
+	for _, format := range WHEN_FORMATS {
+		t, err := time.ParseInLocation(format, when, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+
+	ago, err := parseDuration(when)
+	if err == nil {
+		return time.Now().Add(-ago), nil
+	}
+
+	return time.Time{}, errors.New("Could not understand time: " + when)
+}
+
+// Parse a Go duration, which can also be a number of days, e.g. '2d'
+func parseDuration(duration string) (time.Duration, error) {
+
+	// Go durations don't have days, which is what people usually want
+	if strings.HasSuffix(duration, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(duration, "d"))
+		if err == nil {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	}
+
+	return time.ParseDuration(duration)
+}
+
+// loftus status
+//
+// What we're syncing, and who else is on the local network
+func statusCmd(config *Config) error {
+
+	fmt.Println("Directory:", config.syncDir)
+
+	var repoId string
+	backend := NewGitBackend(config, &RealExternal{})
+	if backend.Check() == nil {
+		repoId, _ = backend.RepoId()
+		fmt.Println("Repository:", repoId)
+	}
+
+	if len(config.serverAddr) != 0 {
+		fmt.Println("Server:", config.serverAddr)
+	} else {
+		fmt.Println("Server: none configured, looking on the local network")
+	}
+
+	services, err := browse(STATUS_BROWSE_SECS * time.Second)
+	if err != nil {
+		return err
+	}
+	if len(services) == 0 {
+		fmt.Println("\nNo loftus found on the local network")
+		return nil
+	}
+
+	fmt.Println()
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(out, "NAME\tROLE\tADDRESS\tREPOSITORY\n")
+	for _, service := range services {
+		repo := service.Txt["repo"]
+		if len(repo) != 0 && repo == repoId {
+			repo = "this one"
+		} else if len(repo) != 0 {
+			repo = shortId(repo)
+		}
+		fmt.Fprintf(out, "%s\t%s\t%s\t%s\n", service.Name(), service.Txt["role"], service.Addr(), repo)
+	}
+	return out.Flush()
+}
@@ -2,108 +2,346 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"errors"
 	"log"
+	"math/rand"
 	"net"
+	"strings"
+	"sync"
 	"time"
 )
 
-var isIgnoreNext = false
+/*
+ * Several notifiers at once, e.g. LAN and server
+ */
+
+type MultiNotifier []Notifier
+
+// Announce on every notifier. Returns the errors of any which failed.
+func (self MultiNotifier) Announce(msg *Message) error {
+	var errs []string
+	for _, notifier := range self {
+		err := notifier.Announce(msg)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, ". "))
+	}
+	return nil
+}
+
+// Messages from every notifier go to channel. One failing doesn't stop the others.
+func (self MultiNotifier) Subscribe(channel chan *Message) error {
+	var errs []string
+	for _, notifier := range self {
+		err := notifier.Subscribe(channel)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, ". "))
+	}
+	return nil
+}
+
+func (self MultiNotifier) Close() error {
+	var lastErr error
+	for _, notifier := range self {
+		err := notifier.Close()
+		if err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
 
 /*
- * Sync over local subnet, by UDP broadcast
+ * Sync anywhere, via TCP to remote server
  */
 
-// Send a udp broadcast message on port 51234
-func udpSend(msg string) {
+const (
+	DEFAULT_HEARTBEAT         = 30 * time.Second
+	DEFAULT_HEARTBEAT_TIMEOUT = 90 * time.Second
 
-	// Ignore the next UDP message, because it comes from us
-	isIgnoreNext = true
+	BACKOFF_MIN = time.Second
+	BACKOFF_MAX = 5 * time.Minute
 
-	sock, err := net.Dial("udp", "255.255.255.255:51234")
-	if err != nil {
-		log.Fatal(err)
+	CONN_CONNECTED    = "connected"
+	CONN_RECONNECTING = "reconnecting"
+)
+
+// Connection to the server, as reported to the client loop
+type ConnState struct {
+	State     string // CONN_*
+	Since     time.Time
+	LastError string // Why we last failed to connect, or lost the connection
+}
+
+// How often clients ping, and how long either side waits before giving up
+type Heartbeat struct {
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+type TcpNotifier struct {
+	serverAddr string
+	tlsConf    *tls.Config // nil for plain TCP
+	secret     string
+	sender     string
+	repo       string // Only hear about this repository
+	heartbeat  Heartbeat
+	states     chan ConnState // Each change of connection state. Can be nil.
+	done       chan bool      // Closed by Close
+
+	lock sync.Mutex
+	conn net.Conn // nil while we're not connected
+}
+
+func NewTcpNotifier(
+	serverAddr string,
+	tlsConf *tls.Config,
+	secret string,
+	sender string,
+	repo string,
+	heartbeat Heartbeat,
+	states chan ConnState) *TcpNotifier {
+
+	return &TcpNotifier{
+		serverAddr: serverAddr,
+		tlsConf:    tlsConf,
+		secret:     secret,
+		sender:     sender,
+		repo:       repo,
+		heartbeat:  heartbeat,
+		states:     states,
+		done:       make(chan bool)}
+}
+
+// Send update notification to remote server
+func (self *TcpNotifier) Announce(msg *Message) error {
+
+	self.lock.Lock()
+	conn := self.conn
+	self.lock.Unlock()
+
+	if conn == nil {
+		return errors.New("Not connected to sync server")
 	}
-	defer sock.Close()
+	return tcpSend(conn, msg.Encode())
+}
 
-	sock.Write([]byte(msg))
-	log.Println("UDP broadcast sent")
+// Connect to the server in the background, and put it's messages on channel
+func (self *TcpNotifier) Subscribe(channel chan *Message) error {
+	go self.listen(channel)
+	return nil
 }
 
-// Listen for UDP broadcast message on port 51234,
-// and put them on the channel. Run it in a go routine.
-func udpListen(channel chan string) {
+func (self *TcpNotifier) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
 
-	listener, err := net.ListenPacket("udp", "255.255.255.255:51234")
-	if err != nil {
-		log.Fatal(err)
+	select {
+	case <-self.done:
+		return nil // Already closed
+	default:
+		close(self.done)
+	}
+	if self.conn != nil {
+		return self.conn.Close()
 	}
-	defer listener.Close()
+	return nil
+}
 
-	for {
-		buf := make([]byte, 1024)
-		listener.ReadFrom(buf)
-		if isIgnoreNext {
-			isIgnoreNext = false
+// Listen for messages from the server. Auto-reconnect, backing off
+// while the server is unreachable. Tells the client loop about each
+// change of connection state.
+func (self *TcpNotifier) listen(channel chan *Message) {
+
+	state := ConnState{State: CONN_RECONNECTING, Since: time.Now()}
+	attempt := 0
+
+	for { // Loop for auto-reconnect
+		conn, bufRead, err := getRemoteConnection(self.serverAddr, self.tlsConf, self.secret, self.sender)
+		if err != nil {
+			wait := backoff(attempt)
+			attempt++
+			log.Println(err, "- retrying in", wait.Round(time.Second))
+
+			state.LastError = err.Error()
+			self.report(state)
+			select {
+			case <-self.done:
+				return
+			case <-time.After(wait):
+			}
 			continue
 		}
-		log.Println("UDP msg received:", string(buf))
-		channel <- string(buf)
+
+		log.Println("Connected to sync server", self.serverAddr)
+		attempt = 0
+		if !self.setConn(conn) {
+			conn.Close()
+			return
+		}
+		state = ConnState{State: CONN_CONNECTED, Since: time.Now(), LastError: state.LastError}
+		self.report(state)
+
+		// Only hear about our repository. A new one has no id yet,
+		// the server subscribes us when we send our first update.
+		if len(self.repo) != 0 {
+			tcpSend(conn, NewMessage(MSG_SUBSCRIBE, self.repo, self.sender, "").Encode())
+		}
+
+		stopPing := make(chan bool)
+		go self.heartbeat.ping(conn, stopPing)
+
+		err = self.read(conn, bufRead, channel)
+		close(stopPing)
+		conn.Close()
+
+		if !self.setConn(nil) {
+			return
+		}
+
+		log.Println("Remote read error - re-connecting.", err)
+		state = ConnState{State: CONN_RECONNECTING, Since: time.Now(), LastError: err.Error()}
+		self.report(state)
 	}
+}
+
+// Pass messages from the server to channel, until the connection fails
+func (self *TcpNotifier) read(conn net.Conn, bufRead *bufio.Reader, channel chan *Message) error {
+	for {
+		// The server answers our pings, so silence means it's gone,
+		// or we were suspended long enough for it to forget us.
+		conn.SetReadDeadline(time.Now().Add(self.heartbeat.Timeout))
+		content, err := bufRead.ReadString('\n')
+		if err != nil {
+			return err
+		}
 
+		msg, err := decodeMessage(content)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if msg.Type == MSG_PONG {
+			continue
+		}
+		msg.Peer = "" // Peers are only reachable on the local network, see peer.go
+		log.Println("Remote sent: " + content)
+
+		select {
+		case channel <- msg:
+		case <-self.done:
+			return errors.New("closed")
+		}
+	}
 }
 
-/*
- * Sync anywhere, via TCP to remote server
- */
+// Remember the current connection, for Announce and Close.
+// False if we've been closed, so should stop.
+func (self *TcpNotifier) setConn(conn net.Conn) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
 
-// Global because shared by tcpListen and tcpSend. Maybe make an object?
-var remoteConn net.Conn
+	select {
+	case <-self.done:
+		return false
+	default:
+		self.conn = conn
+		return true
+	}
+}
 
-// Listen for messages from the server. Auto-reconnect.
-func tcpListen(serverAddr string, channel chan string) {
+// Tell whoever is interested that the connection changed
+func (self *TcpNotifier) report(state ConnState) {
+	if self.states == nil {
+		return
+	}
+	select {
+	case self.states <- state:
+	case <-self.done:
+	}
+}
 
-	for { // Loop for auto-reconnect
-		remoteConn = getRemoteConnection(serverAddr, true)
-		defer remoteConn.Close()
-		//Info("Connected to remote sync server")
+// How long to wait before connection attempt number 'attempt' (from 0).
+// Doubles each time up to BACKOFF_MAX, randomly shortened by up to half
+// so that clients of a restarted server don't all come back at once.
+func backoff(attempt int) time.Duration {
 
-		bufRead := bufio.NewReader(remoteConn)
+	wait := BACKOFF_MAX
+	if attempt < 16 { // Don't overflow the shift
+		wait = BACKOFF_MIN << uint(attempt)
+	}
+	if wait > BACKOFF_MAX {
+		wait = BACKOFF_MAX
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
 
-		for { // Connection work loop
-			content, err := bufRead.ReadString('\n')
-			if err != nil {
-				log.Println("Remote read error - re-connecting")
-				remoteConn.Close()
-				break
-			}
-			log.Println("Remote sent: " + content)
+// Get an authenticated connection to remote server which tells us when to pull.
+// The reader must be used for everything the server sends afterwards.
+// TLS if tlsConf isn't nil.
+func getRemoteConnection(
+	serverAddr string,
+	tlsConf *tls.Config,
+	secret string,
+	sender string) (net.Conn, *bufio.Reader, error) {
 
-			channel <- content
-		}
+	conn, err := dialServer(serverAddr, tlsConf)
+	if err != nil {
+		return nil, nil, errors.New("Connecting to " + serverAddr + ": " + err.Error())
 	}
 
+	bufRead := bufio.NewReader(conn)
+	err = clientHandshake(conn, bufRead, secret, sender)
+	if err != nil {
+		conn.Close()
+		return nil, nil, errors.New("Authenticating with " + serverAddr + ": " + err.Error())
+	}
+	return conn, bufRead, nil
+}
+
+// Both must be positive. A zero interval can't tick, and a zero timeout
+// would drop every connection as soon as it's made.
+func (self Heartbeat) Check() error {
+	if self.Interval <= 0 {
+		return errors.New("--heartbeat must be more than 0, not " + self.Interval.String())
+	}
+	if self.Timeout <= 0 {
+		return errors.New("--heartbeat-timeout must be more than 0, not " + self.Timeout.String())
+	}
+	return nil
 }
 
-// Get a connection to remote server which tells us when to pull
-func getRemoteConnection(serverAddr string, isReconnect bool) net.Conn {
+// Send a ping every interval, until stop is closed
+func (self Heartbeat) ping(conn net.Conn, stop chan bool) {
 
-	var conn net.Conn
-	var err error
+	ticker := time.NewTicker(self.Interval)
+	defer ticker.Stop()
+
+	ping := NewMessage(MSG_PING, "", "", "").Encode()
 	for {
-		conn, err = net.Dial("tcp", serverAddr)
-		if err == nil {
-			break
-		}
-		if isReconnect {
-			time.Sleep(10 * time.Second)
-		} else {
-			break
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := tcpSend(conn, ping)
+			if err != nil {
+				// The read deadline will notice too, this is only quicker
+				conn.Close()
+				return
+			}
 		}
 	}
-	return conn
 }
 
-// Send update notification to remote server
+// Send a message to the remote server
 func tcpSend(conn net.Conn, msg string) error {
 	_, err := conn.Write([]byte(msg))
 	return err
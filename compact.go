@@ -0,0 +1,466 @@
+// Squash old history according to a retention policy
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Every commit for a week, hourly for a month, daily after that
+	DEFAULT_RETENTION = "7d:*,30d:1h,*:1d"
+
+	TRAILER_COMPACTED = "Loftus-Compacted"
+)
+
+// Commits up to MaxAge old are kept one per Every. Zero MaxAge means any age,
+// zero Every means keep them all.
+type RetentionRule struct {
+	MaxAge time.Duration
+	Every  time.Duration
+}
+
+type RetentionPolicy []RetentionRule
+
+// Parse a policy such as "7d:*,30d:1h,*:1d": a comma separated list of
+// <max age>:<keep one per>, where * means unlimited.
+func parseRetention(spec string) (RetentionPolicy, error) {
+
+	var policy RetentionPolicy
+
+	for _, part := range strings.Split(spec, ",") {
+
+		ruleParts := strings.Split(strings.TrimSpace(part), ":")
+		if len(ruleParts) != 2 {
+			return nil, errors.New("Retention rule must be <max age>:<keep one per>, not: " + part)
+		}
+
+		var rule RetentionRule
+		var err error
+
+		if ruleParts[0] != "*" {
+			rule.MaxAge, err = parseDuration(ruleParts[0])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if ruleParts[1] != "*" {
+			rule.Every, err = parseDuration(ruleParts[1])
+			if err != nil {
+				return nil, err
+			}
+			// Commit times are in seconds, so anything less can't be a bucket
+			if rule.Every < time.Second {
+				return nil, errors.New("Retention rule must keep one per second or longer, not: " + part)
+			}
+		}
+
+		policy = append(policy, rule)
+	}
+
+	return policy, nil
+}
+
+// Which of revisions (oldest first) should we keep? Within a rule's bucket
+// we keep the newest revision, because it has the state the others led to.
+// The first and last revisions are always kept.
+func (self RetentionPolicy) Keep(revisions []Revision, now time.Time) []bool {
+
+	keep := make([]bool, len(revisions))
+
+	for index, rev := range revisions {
+
+		if index == 0 || index == len(revisions)-1 {
+			keep[index] = true
+			continue
+		}
+
+		rule, slot := self.bucket(rev.When, now)
+		nextRule, nextSlot := self.bucket(revisions[index+1].When, now)
+
+		keep[index] = slot == -1 || rule != nextRule || slot != nextSlot
+	}
+
+	return keep
+}
+
+// Does a rule keep every commit made at 'when'?
+func (self RetentionPolicy) KeepsAll(when time.Time, now time.Time) bool {
+	_, slot := self.bucket(when, now)
+	return slot == -1
+}
+
+// Which rule applies to a commit made at 'when', and which of that rule's
+// slots it's in. Slot -1 means the rule keeps everything.
+func (self RetentionPolicy) bucket(when time.Time, now time.Time) (int, int64) {
+	age := now.Sub(when)
+	for index, rule := range self {
+		if rule.MaxAge == 0 || age <= rule.MaxAge {
+			if rule.Every == 0 {
+				return index, -1
+			}
+			return index, when.Unix() / int64(rule.Every.Seconds())
+		}
+	}
+	// Older than every rule, treat like the last one
+	return len(self), 0
+}
+
+// loftus compact [--keep=<policy>]
+//
+// Squash old history. Run it on the server's bare repository, or on a
+// single client. Other clients notice the rewrite on their next pull.
+func compactCmd(config *Config) error {
+
+	policy, err := parseRetention(config.keep)
+	if err != nil {
+		return err
+	}
+
+	backend, err := commandBackend(config)
+	if err != nil {
+		return err
+	}
+
+	removed, err := backend.Compact(policy)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Compaction removed", removed, "commits")
+	return nil
+}
+
+// Rewrite history so that only the commits policy keeps remain, each
+// with the same contents and dates as before. Returns how many were removed.
+//
+// The policy applies to the first parent line, which is what the server saw.
+// Where it keeps everything, merges keep all their parents, so other hosts'
+// commits survive. Where it thins history out, kept commits have only their
+// first parent, so what was merged in is squashed in to them too.
+func (self *GitBackend) Compact(policy RetentionPolicy) (int, error) {
+
+	isBare, err := self.gitOutput("rev-parse", "--is-bare-repository")
+	if err != nil {
+		return 0, err
+	}
+	isClient := strings.TrimSpace(isBare) != "true"
+
+	if isClient {
+		// Make sure we're rewriting what everyone else has
+		err = self.Pull()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	branch, err := self.gitOutput("symbolic-ref", "HEAD")
+	if err != nil {
+		return 0, err
+	}
+	branch = strings.TrimSpace(branch)
+
+	revisions, err := self.log("--first-parent", "--reverse", "HEAD")
+	if err != nil {
+		return 0, err
+	}
+	if len(revisions) == 0 {
+		return 0, nil
+	}
+
+	now := time.Now()
+	keep := policy.Keep(revisions, now)
+
+	parents, err := self.parents()
+	if err != nil {
+		return 0, err
+	}
+
+	// Snapshots must survive, so keep their commits
+	snapTags, err := self.snapshotTags()
+	if err != nil {
+		return 0, err
+	}
+	for index, rev := range revisions {
+		keep[index] = keep[index] || len(snapTags[rev.Id]) != 0
+	}
+
+	// Old commit id to new. Commits which don't change keep their id.
+	// A dropped commit maps to the kept one before it, for anything merged
+	// later which was based on it.
+	newIds := make(map[string]string)
+	var head string
+	squashed := 0
+
+	for index, rev := range revisions {
+
+		if !keep[index] {
+			newIds[rev.Id] = head
+			squashed++
+			continue
+		}
+
+		var newParents []string
+		if index != 0 {
+			newParents = append(newParents, head)
+		}
+		if policy.KeepsAll(rev.When, now) && len(parents[rev.Id]) > 1 {
+			for _, merged := range parents[rev.Id][1:] {
+				newParent, err := self.rewriteMerged(merged, parents, newIds)
+				if err != nil {
+					return 0, err
+				}
+				newParents = appendNew(newParents, newParent)
+			}
+		}
+
+		head, err = self.rewriteCommit(rev.Id, parents[rev.Id], newParents, squashed)
+		if err != nil {
+			return 0, err
+		}
+		newIds[rev.Id] = head
+		squashed = 0
+	}
+
+	oldHead := revisions[len(revisions)-1].Id
+	if head == oldHead {
+		return 0, nil
+	}
+	log.Println("Replacing", oldHead, "with", head)
+
+	// Fails if someone pushed meanwhile
+	_, err = self.gitOutput("update-ref", branch, head, oldHead)
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := self.gitOutput("rev-list", "--count", head)
+	if err != nil {
+		return 0, err
+	}
+	remaining, _ := strconv.Atoi(strings.TrimSpace(count))
+	removed := len(parents) - remaining
+
+	for oldId, tags := range snapTags {
+		newId, ok := newIds[oldId]
+		if !ok || newId == oldId {
+			continue
+		}
+		for _, tag := range tags {
+			err = self.retag(tag, newId)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if isClient {
+		_, err = self.gitOutput("push", "--force-with-lease", "origin", "HEAD")
+		if err == nil {
+			_, err = self.gitOutput("push", "--force", "--tags", "origin")
+		}
+		if err != nil {
+			return 0, errors.New("Could not push compacted history. " +
+				"If the server sets receive.denyNonFastForwards, run compact on the server. " + err.Error())
+		}
+	}
+
+	// A client's reflog is how to undo a mistake, so only prune the server
+	if !isClient {
+		self.prune()
+	}
+	return removed, nil
+}
+
+// Run: git rev-list --parents HEAD
+// Every commit's parents, first parent first, by commit id.
+func (self *GitBackend) parents() (map[string][]string, error) {
+
+	output, err := self.gitOutput("rev-list", "--parents", "HEAD")
+	if err != nil {
+		return nil, err
+	}
+
+	parents := make(map[string][]string)
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		ids := strings.Fields(line)
+		if len(ids) != 0 {
+			parents[ids[0]] = ids[1:]
+		}
+	}
+	return parents, nil
+}
+
+// Rewrite a commit which was merged in where we keep everything, on to the
+// new history. It's ancestors first, unless newIds already has them.
+func (self *GitBackend) rewriteMerged(
+	id string,
+	parents map[string][]string,
+	newIds map[string]string) (string, error) {
+
+	if newId, ok := newIds[id]; ok {
+		return newId, nil
+	}
+
+	var newParents []string
+	for _, parent := range parents[id] {
+		newParent, err := self.rewriteMerged(parent, parents, newIds)
+		if err != nil {
+			return "", err
+		}
+		newParents = appendNew(newParents, newParent)
+	}
+
+	newId, err := self.rewriteCommit(id, parents[id], newParents, 0)
+	if err != nil {
+		return "", err
+	}
+	newIds[id] = newId
+	return newId, nil
+}
+
+// Add id to ids, unless it's already there
+func appendNew(ids []string, id string) []string {
+	for _, existing := range ids {
+		if existing == id {
+			return ids
+		}
+	}
+	return append(ids, id)
+}
+
+// Snapshot tag names, by the id of the commit they label
+func (self *GitBackend) snapshotTags() (map[string][]string, error) {
+
+	output, err := self.gitOutput(
+		"for-each-ref", "--format=%(*objectname) %(refname)", "refs/tags/"+SNAPSHOT_PREFIX)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string][]string)
+	for _, line := range strings.Split(output, "\n") {
+		lineParts := strings.Split(line, " ")
+		if len(lineParts) == 2 {
+			tags[lineParts[0]] = append(tags[lineParts[0]], lineParts[1])
+		}
+	}
+	return tags, nil
+}
+
+// Point an annotated tag at a rewritten commit, keeping it's message and date
+func (self *GitBackend) retag(tag string, commitId string) error {
+
+	original, err := self.gitOutput("cat-file", "tag", tag)
+	if err != nil {
+		return err
+	}
+
+	// Headers are object, type, tag and tagger, then a blank line and the message
+	parts := strings.SplitN(original, "\n\n", 2)
+	if len(parts) != 2 {
+		return errors.New("Could not parse tag " + tag)
+	}
+
+	headers := strings.Split(parts[0], "\n")
+	headers[0] = "object " + commitId
+
+	newId, err := self.writeObject("tag", strings.Join(headers, "\n")+"\n\n"+parts[1])
+	if err != nil {
+		return err
+	}
+
+	_, err = self.gitOutput("update-ref", tag, newId)
+	return err
+}
+
+// Write a copy of commit id with new parents, recording how many commits
+// were squashed into it. Returns the new commit id, which is the old one
+// if nothing changed.
+func (self *GitBackend) rewriteCommit(
+	id string,
+	oldParents []string,
+	newParents []string,
+	squashed int) (string, error) {
+
+	if squashed == 0 && strings.Join(oldParents, " ") == strings.Join(newParents, " ") {
+		return id, nil
+	}
+
+	original, err := self.gitOutput("cat-file", "commit", id)
+	if err != nil {
+		return "", err
+	}
+
+	// Headers, blank line, message
+	parts := strings.SplitN(original, "\n\n", 2)
+	if len(parts) != 2 {
+		return "", errors.New("Could not parse commit " + id)
+	}
+
+	// Keep tree, author and committer (which have the dates), replace parents.
+	// Signatures would no longer match, so drop them.
+	headers := []string{}
+	isSignature := false
+	for _, line := range strings.Split(parts[0], "\n") {
+
+		isContinuation := strings.HasPrefix(line, " ")
+		if !isContinuation {
+			isSignature = strings.HasPrefix(line, "gpgsig") || strings.HasPrefix(line, "mergetag")
+		}
+
+		switch {
+		case isSignature || strings.HasPrefix(line, "parent "):
+			continue
+		case strings.HasPrefix(line, "tree "):
+			headers = append(headers, line)
+			for _, parent := range newParents {
+				headers = append(headers, "parent "+parent)
+			}
+		default:
+			headers = append(headers, line)
+		}
+	}
+
+	msg := strings.TrimRight(parts[1], "\n")
+	if squashed != 0 {
+		// Trailers go in their own paragraph
+		if !strings.Contains(msg, "\n\n") {
+			msg += "\n"
+		}
+		msg += "\n" + TRAILER_COMPACTED + ": " + strconv.Itoa(squashed)
+	}
+
+	return self.writeObject("commit", strings.Join(headers, "\n")+"\n\n"+msg+"\n")
+}
+
+// Run: git hash-object -t objType -w
+// Stores a raw object in the repository, returning it's id.
+func (self *GitBackend) writeObject(objType string, content string) (string, error) {
+
+	tmp, err := os.CreateTemp("", "loftus-"+objType)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.WriteString(content)
+	tmp.Close()
+	if err != nil {
+		return "", err
+	}
+
+	newId, err := self.gitOutput("hash-object", "-t", objType, "-w", tmp.Name())
+	return strings.TrimSpace(newId), err
+}
+
+// Throw away the objects which only old history used. Server only.
+func (self *GitBackend) prune() {
+	self.git("reflog", "expire", "--expire=now", "--all")
+	self.git("gc", "--prune=now", "--quiet")
+}
@@ -0,0 +1,270 @@
+// Control a running client through a unix socket, with 'loftus ctl'.
+//
+// Requests and responses are a line of JSON each. The socket's handlers
+// pass requests to the client's main loop, which owns all the state,
+// and wait for it's answer.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	CTL_STATUS   = "status"   // How are things?
+	CTL_SYNC     = "sync"     // Sync now, instead of waiting for the watcher to go quiet
+	CTL_PAUSE    = "pause"    // Stop committing changes until resume
+	CTL_RESUME   = "resume"   // Commit what changed while paused, and carry on
+	CTL_ACTIVITY = "activity" // What happened recently
+
+	MAX_ACTIVITY     = 50 // Entries the client remembers for 'activity'
+	CTL_TIMEOUT_SECS = 60 // A sync can take a while
+)
+
+type CtlRequest struct {
+	Command string   `json:"command"` // CTL_*
+	Args    []string `json:"args,omitempty"`
+}
+
+type CtlResponse struct {
+	Error    string     `json:"error,omitempty"`
+	Status   *CtlStatus `json:"status,omitempty"`
+	Activity []Activity `json:"activity,omitempty"`
+}
+
+type CtlStatus struct {
+	Dir        string     `json:"dir"`
+	Online     bool       `json:"online"` // Can reach the git remote
+	Paused     bool       `json:"paused"`
+	ResumeAt   *time.Time `json:"resume_at,omitempty"` // When we'll resume by ourselves
+	Server     string     `json:"server,omitempty"`
+	Connection string     `json:"connection,omitempty"` // CONN_*, to the server
+	LastSync   *time.Time `json:"last_sync,omitempty"`
+	Pending    int        `json:"pending_events"` // Watcher events not committed yet
+	LastError  string     `json:"last_error,omitempty"`
+}
+
+// Something the client did, for 'loftus ctl activity'
+type Activity struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// A request waiting for the client's main loop
+type ctlCall struct {
+	request CtlRequest
+	reply   chan CtlResponse
+}
+
+type ControlServer struct {
+	listener net.Listener
+	calls    chan *ctlCall
+}
+
+// Listen on path, and put requests on calls for the client to answer
+func NewControlServer(path string, calls chan *ctlCall) (*ControlServer, error) {
+
+	// A previous run may have left it behind, but don't take over a live one
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return nil, errors.New("Another loftus is already using control socket " + path)
+	}
+	os.Remove(path)
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only our user can control us
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	log.Println("Listening for 'loftus ctl' on", path)
+
+	server := &ControlServer{listener: listener, calls: calls}
+	go server.serve()
+	return server, nil
+}
+
+// Stop listening. Also removes the socket file.
+func (self *ControlServer) Close() error {
+	return self.listener.Close()
+}
+
+func (self *ControlServer) serve() {
+	for {
+		conn, err := self.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Println("Control accept:", err)
+			continue
+		}
+		go self.handle(conn)
+	}
+}
+
+// Answer each request on conn, in order
+func (self *ControlServer) handle(conn net.Conn) {
+
+	defer conn.Close()
+	bufRead := bufio.NewReader(conn)
+
+	for {
+		line, err := bufRead.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		var response CtlResponse
+		call := &ctlCall{reply: make(chan CtlResponse, 1)}
+		err = json.Unmarshal([]byte(line), &call.request)
+		if err != nil {
+			response.Error = "Invalid request: " + line
+		} else {
+			self.calls <- call
+			response = <-call.reply
+		}
+
+		answer, _ := json.Marshal(response)
+		_, err = conn.Write(append(answer, '\n'))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Answer a request from 'loftus ctl'. Runs in the main loop.
+func (self *Client) handleControl(request CtlRequest) CtlResponse {
+
+	switch request.Command {
+
+	case CTL_STATUS:
+		return CtlResponse{Status: self.status()}
+
+	case CTL_SYNC:
+		if self.paused {
+			return CtlResponse{Error: "Paused, resume first"}
+		}
+		err := self.syncPending(TRIGGER_CONTROL)
+		if err != nil {
+			return CtlResponse{Error: err.Error()}
+		}
+		return CtlResponse{Status: self.status()}
+
+	case CTL_PAUSE:
+		var timeout time.Duration
+		if len(request.Args) != 0 {
+			var err error
+			timeout, err = time.ParseDuration(request.Args[0])
+			if err != nil {
+				return CtlResponse{Error: "Pause for how long? " + err.Error()}
+			}
+		}
+		self.pause(timeout)
+		return CtlResponse{Status: self.status()}
+
+	case CTL_RESUME:
+		err := self.resume()
+		if err != nil {
+			return CtlResponse{Error: err.Error()}
+		}
+		return CtlResponse{Status: self.status()}
+
+	case CTL_ACTIVITY:
+		return CtlResponse{Activity: append([]Activity(nil), self.activity...)}
+	}
+
+	return CtlResponse{Error: "Unknown command: " + request.Command}
+}
+
+func (self *Client) status() *CtlStatus {
+
+	status := &CtlStatus{
+		Dir:        self.syncDir,
+		Online:     self.isOnline,
+		Paused:     self.paused,
+		Server:     self.serverAddr,
+		Connection: self.conn.State,
+		Pending:    len(self.pending),
+		LastError:  self.lastError,
+	}
+	if !self.lastSync.IsZero() {
+		lastSync := self.lastSync // The socket's goroutine encodes it
+		status.LastSync = &lastSync
+	}
+	if !self.pausedUntil.IsZero() {
+		resumeAt := self.pausedUntil
+		status.ResumeAt = &resumeAt
+	}
+	return status
+}
+
+// Remember what we did, for 'loftus ctl activity'. Oldest is forgotten first.
+func (self *Client) record(msg string) {
+	self.activity = append(self.activity, Activity{Time: time.Now(), Message: msg})
+	if len(self.activity) > MAX_ACTIVITY {
+		self.activity = self.activity[len(self.activity)-MAX_ACTIVITY:]
+	}
+}
+
+// loftus ctl <status|sync|pause [duration]|resume|activity> [--control=<path>]
+//
+// Ask the running client to do something, and print it's JSON answer.
+func ctlCmd(config *Config) error {
+
+	if len(config.args) == 0 {
+		return errors.New("Usage: loftus ctl <status|sync|pause [duration]|resume|activity>")
+	}
+
+	answer, err := ctlRequest(config.ctlPath, config.args[0], config.args[1:]...)
+	if err != nil {
+		return err
+	}
+
+	var pretty bytes.Buffer
+	json.Indent(&pretty, answer, "", "  ")
+	fmt.Print(pretty.String())
+
+	var response CtlResponse
+	json.Unmarshal(answer, &response)
+	if len(response.Error) != 0 {
+		return errors.New(response.Error)
+	}
+	return nil
+}
+
+// Send command to the client listening on path, and return it's answer
+func ctlRequest(path string, command string, args ...string) ([]byte, error) {
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, errors.New("Cannot connect to loftus on " + path + ", is it running? " + err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(CTL_TIMEOUT_SECS * time.Second))
+
+	request, _ := json.Marshal(CtlRequest{Command: command, Args: args})
+	_, err = conn.Write(append(request, '\n'))
+	if err != nil {
+		return nil, err
+	}
+
+	answer, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return nil, errors.New("No answer from loftus: " + err.Error())
+	}
+	return answer, nil
+}
@@ -0,0 +1,348 @@
+// Put synced files where programs expect them, e.g. ~/.bashrc
+//
+// The manifest, .loftus/deploy in the sync directory, has a line per file:
+//
+//	# repo path    target, relative to $HOME    [copy]
+//	bashrc         .bashrc
+//	config/i3      .config/i3
+//	ssh/config     .ssh/config                  copy
+//
+// Targets are symlinks to the repo, or copies if the line ends with 'copy'.
+// Programs which save by replacing the symlink with a real file are noticed
+// and the new file is adopted back into the repo.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	DEPLOY_MANIFEST   = ".loftus/deploy"
+	DEPLOY_STATE      = "loftus/deployed" // Under .git
+	DEPLOY_CHECK_SECS = 60
+	BACKUP_SUFFIX     = ".loftus-backup"
+)
+
+type DeployEntry struct {
+	Source string // Absolute path in the sync directory
+	Target string // Absolute path, usually in $HOME
+	IsCopy bool
+}
+
+type Deployer struct {
+	syncDir string
+	home    string
+}
+
+func NewDeployer(syncDir string) *Deployer {
+	return &Deployer{syncDir: syncDir, home: os.Getenv("HOME")}
+}
+
+// loftus deploy
+//
+// Create or repair every target in the manifest, once
+func deployCmd(config *Config) error {
+
+	deployer := NewDeployer(config.syncDir)
+	adopted, err := deployer.Deploy()
+	for _, target := range adopted {
+		log.Println("Adopted", target, "into", config.syncDir)
+	}
+	return err
+}
+
+// Bring every target in the manifest up to date.
+// Returns the targets which we copied back into the repo.
+func (self *Deployer) Deploy() ([]string, error) {
+
+	content, err := os.ReadFile(filepath.Join(self.syncDir, DEPLOY_MANIFEST))
+	if os.IsNotExist(err) {
+		return nil, errors.New("No deploy manifest. Create " + DEPLOY_MANIFEST + " in " + self.syncDir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := self.parseManifest(string(content))
+	if err != nil {
+		return nil, err
+	}
+
+	statePath := filepath.Join(self.syncDir, ".git", DEPLOY_STATE)
+	previous := make(map[string]bool)
+	state, _ := os.ReadFile(statePath)
+	for _, target := range strings.Split(string(state), "\n") {
+		previous[target] = true
+	}
+
+	var adopted, deployed []string
+	for _, entry := range entries {
+
+		var isAdopted bool
+		if entry.IsCopy {
+			isAdopted, err = self.deployCopy(entry)
+		} else {
+			isAdopted, err = self.deployLink(entry, previous[entry.Target])
+		}
+
+		if err != nil {
+			log.Println("Error deploying", entry.Target, err)
+			continue
+		}
+		if isAdopted {
+			adopted = append(adopted, entry.Target)
+		}
+		deployed = append(deployed, entry.Target)
+	}
+
+	err = os.MkdirAll(filepath.Dir(statePath), 0755)
+	if err != nil {
+		return adopted, err
+	}
+	return adopted, os.WriteFile(statePath, []byte(strings.Join(deployed, "\n")), 0644)
+}
+
+// Parse the manifest, see top of file.
+// The manifest is synced from other machines, so repo paths must stay in the
+// sync directory and targets in $HOME, otherwise it could overwrite anything.
+func (self *Deployer) parseManifest(content string) ([]DeployEntry, error) {
+
+	var entries []DeployEntry
+	syncDir := filepath.Clean(self.syncDir)
+	home := filepath.Clean(self.home)
+
+	for num, line := range strings.Split(content, "\n") {
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		lineErr := func(msg string) error {
+			return errors.New(DEPLOY_MANIFEST + " line " + strconv.Itoa(num+1) + ": " + msg)
+		}
+
+		isCopy := len(fields) == 3 && fields[2] == "copy"
+		if len(fields) != 2 && !isCopy {
+			return nil, lineErr("expected '<repo path> <target> [copy]'")
+		}
+
+		source := filepath.Join(syncDir, fields[0])
+		if source == syncDir || !isInside(syncDir, source) || isInside(filepath.Join(syncDir, ".git"), source) {
+			return nil, lineErr("repo path must be inside " + syncDir + ": " + fields[0])
+		}
+
+		target := fields[1]
+		if strings.HasPrefix(target, "~/") {
+			target = target[2:]
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(home, target)
+		}
+		if len(self.home) == 0 || target == home || !isInside(home, target) {
+			return nil, lineErr("target must be inside $HOME (" + home + "): " + fields[1])
+		}
+
+		entries = append(entries, DeployEntry{
+			Source: source,
+			Target: filepath.Clean(target),
+			IsCopy: isCopy})
+	}
+
+	return entries, nil
+}
+
+// Make target a symlink to source. wasDeployed means we made it before,
+// so if it's now a real file a program replaced our link, and we adopt it.
+func (self *Deployer) deployLink(entry DeployEntry, wasDeployed bool) (bool, error) {
+
+	info, err := os.Lstat(entry.Target)
+
+	switch {
+
+	case os.IsNotExist(err):
+		_, err = os.Stat(entry.Source)
+		if err != nil {
+			return false, err
+		}
+		return false, self.link(entry)
+
+	case err != nil:
+		return false, err
+
+	case info.Mode()&os.ModeSymlink != 0:
+		current, _ := os.Readlink(entry.Target)
+		if current == entry.Source {
+			return false, nil
+		}
+		if !wasDeployed {
+			log.Println("Not replacing symlink", entry.Target, "->", current)
+			return false, nil
+		}
+		err = os.Remove(entry.Target)
+		if err != nil {
+			return false, err
+		}
+		return false, self.link(entry)
+	}
+
+	// Target is a real file or directory
+
+	_, err = os.Stat(entry.Source)
+	if os.IsNotExist(err) {
+		// New to the repo, move it in
+		err = self.adopt(entry)
+		return true, err
+	}
+
+	if !info.IsDir() && sameContent(entry.Source, entry.Target) {
+		err = os.Remove(entry.Target)
+		if err != nil {
+			return false, err
+		}
+		return false, self.link(entry)
+	}
+
+	if wasDeployed && !info.IsDir() {
+		err = copyFile(entry.Target, entry.Source)
+		if err == nil {
+			err = os.Remove(entry.Target)
+		}
+		if err != nil {
+			return false, err
+		}
+		return true, self.link(entry)
+	}
+
+	// Someone else's file. Keep it, but out of the way.
+	log.Println("Moving", entry.Target, "to", entry.Target+BACKUP_SUFFIX)
+	err = os.Rename(entry.Target, entry.Target+BACKUP_SUFFIX)
+	if err != nil {
+		return false, err
+	}
+	return false, self.link(entry)
+}
+
+// Keep target a copy of source. Whichever changed last wins.
+func (self *Deployer) deployCopy(entry DeployEntry) (bool, error) {
+
+	targetInfo, targetErr := os.Stat(entry.Target)
+	sourceInfo, sourceErr := os.Stat(entry.Source)
+
+	switch {
+
+	case os.IsNotExist(targetErr) && sourceErr == nil:
+		err := os.MkdirAll(filepath.Dir(entry.Target), 0755)
+		if err != nil {
+			return false, err
+		}
+		return false, copyFile(entry.Source, entry.Target)
+
+	case targetErr != nil:
+		return false, targetErr
+
+	case os.IsNotExist(sourceErr):
+		return true, self.adopt(entry)
+
+	case sourceErr != nil:
+		return false, sourceErr
+
+	case sameContent(entry.Source, entry.Target):
+		return false, nil
+
+	case targetInfo.ModTime().After(sourceInfo.ModTime()):
+		return true, copyFile(entry.Target, entry.Source)
+
+	default:
+		return false, copyFile(entry.Source, entry.Target)
+	}
+}
+
+// Move (or copy) target into the repo at source.
+// Symlinked targets are then linked back.
+func (self *Deployer) adopt(entry DeployEntry) error {
+
+	err := os.MkdirAll(filepath.Dir(entry.Source), 0755)
+	if err != nil {
+		return err
+	}
+
+	if entry.IsCopy {
+		return copyFile(entry.Target, entry.Source)
+	}
+
+	err = os.Rename(entry.Target, entry.Source)
+	if err != nil {
+		// Probably a different filesystem, so copy instead
+		err = copyFile(entry.Target, entry.Source)
+		if err == nil {
+			err = os.Remove(entry.Target)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return self.link(entry)
+}
+
+// Create target as a symlink to source, and any directories it needs
+func (self *Deployer) link(entry DeployEntry) error {
+
+	err := os.MkdirAll(filepath.Dir(entry.Target), 0755)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Linking", entry.Target, "->", entry.Source)
+	return os.Symlink(entry.Source, entry.Target)
+}
+
+// Do both files have the same contents?
+func sameContent(one string, two string) bool {
+	oneContent, err := os.ReadFile(one)
+	if err != nil {
+		return false
+	}
+	twoContent, err := os.ReadFile(two)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(oneContent, twoContent)
+}
+
+// Copy contents and permissions of file 'from' over file 'to'
+func copyFile(from string, to string) error {
+
+	info, err := os.Stat(from)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	closeErr := out.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return os.Chmod(to, info.Mode())
+}
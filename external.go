@@ -2,13 +2,15 @@
 package main
 
 import (
+	"bytes"
 	"log"
 	"os/exec"
 	"strings"
 )
 
 type External interface {
-	// Run a third party app, return it's output and any error
+	// Run a third party app, return it's standard output and any error.
+	// Use errorOutput for what it said on stderr when it failed.
 	Exec(rootDir string, cmd string, args ...string) ([]byte, error)
 }
 
@@ -23,5 +25,23 @@ func (self *RealExternal) Exec(rootDir string, cmd string, args ...string) ([]by
 
 	log.Println(cmd, strings.Join(args, " "))
 
-	return cmdObj.CombinedOutput()
+	// Kept apart, so that warnings don't end up in e.g. a restored file
+	var stderr bytes.Buffer
+	cmdObj.Stderr = &stderr
+	output, err := cmdObj.Output()
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		exitErr.Stderr = stderr.Bytes()
+	} else if err == nil && stderr.Len() != 0 {
+		log.Println(strings.TrimSpace(stderr.String()))
+	}
+	return output, err
+}
+
+// What a command which failed said on stderr, if Exec kept it
+func errorOutput(err error) string {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return string(exitErr.Stderr)
+	}
+	return ""
 }
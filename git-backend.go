@@ -3,13 +3,17 @@ package main
 import (
 	"errors"
 	"log"
+	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 const (
 	MAX_SUMMARY_NAMES = 3
+	LAST_REMOTE_REF   = "refs/loftus/last-remote" // The remote head we last merged or rebased on to
 )
 
 type GitBackend struct {
@@ -18,6 +22,11 @@ type GitBackend struct {
 	rootDir  string
 	isOnline bool // Can we talk to remote git / ssh server?
 	pushHook func()
+	hostName string // For host specific overrides and templates
+	userName string
+	vars     TemplateVars
+
+	peerArgs []string // For peer-pipe, when fetching from peers
 }
 
 func NewGitBackend(config *Config, external External) *GitBackend {
@@ -33,7 +42,11 @@ func NewGitBackend(config *Config, external External) *GitBackend {
 		rootDir:  rootDir,
 		gitPath:  gitPath,
 		external: external,
-		isOnline: true}
+		isOnline: true,
+		hostName: config.hostName,
+		userName: os.Getenv("USER"),
+		vars:     config.vars,
+		peerArgs: peerPipeArgs(config)}
 }
 
 // Display summary of changes, and return that summary
@@ -133,9 +146,10 @@ func (self *GitBackend) status(args ...string) (created []string, modified []str
 	return created, modified, deleted
 }
 
-// Run: git push
+// Run: git push --follow-tags
+// Tags are snapshots, which we share like commits.
 func (self *GitBackend) Push() error {
-	err := self.git("push")
+	err := self.git("push", "--follow-tags")
 	if err == nil && self.pushHook != nil {
 		go self.pushHook()
 	}
@@ -145,17 +159,101 @@ func (self *GitBackend) Push() error {
 // Run: git pull
 func (self *GitBackend) Pull() error {
 
+	before := self.lastRemote()
+
 	err := self.git("fetch")
 	if err != nil {
 		return err
 	}
 
-	//self.displayStatus("diff", "origin/master", "--name-status")
-	return self.git("merge", "origin/master")
+	if len(before) != 0 && self.isRewritten(before) {
+		err = self.recoverRewrite(before)
+	} else {
+		//self.displayStatus("diff", "origin/master", "--name-status")
+		err = self.git("merge", "origin/master")
+	}
+	if err != nil {
+		return err
+	}
+
+	// Only now, so if the rebase failed we try again next time,
+	// instead of merging the old history back in
+	err = self.git("update-ref", LAST_REMOTE_REF, "origin/master")
+	if err != nil {
+		return err
+	}
+
+	// Someone might have added a variant for us, or changed a template
+	self.updateGenerated()
+	return nil
+}
+
+// The remote head we last brought in. Not origin/master, which fetch moves
+// whether or not we manage to integrate it. Before the first pull that
+// recorded it, origin/master is the best we have.
+func (self *GitBackend) lastRemote() string {
+	for _, ref := range []string{LAST_REMOTE_REF, "origin/master"} {
+		id, err := self.gitOutput("rev-parse", "--verify", "--quiet", ref)
+		if err == nil {
+			return strings.TrimSpace(id)
+		}
+	}
+	return ""
+}
+
+// Apply host specific overrides and templates, and make git ignore the files
+// they generate. Problems are logged, but don't stop the sync.
+func (self *GitBackend) updateGenerated() {
+
+	variants, templates, err := self.findGenerated()
+	if err != nil {
+		log.Println("Error looking for overrides and templates:", err)
+		return
+	}
+
+	linked := self.applyOverrides(variants)
+	rendered := self.applyTemplates(templates)
+
+	err = self.excludeCanonicals(append(linked, rendered...))
+	if err != nil {
+		log.Println("Error excluding generated files:", err)
+	}
+}
+
+// Has remote history been rewritten (by 'loftus compact') since it was at 'before'?
+func (self *GitBackend) isRewritten(before string) bool {
+	_, err := self.gitOutput("merge-base", "--is-ancestor", before, "origin/master")
+	return err != nil
+}
+
+// Remote history was compacted. Move our local commits since 'before'
+// on to the new history. The old one stays in the reflog, in case the
+// rebase went wrong, until git's usual gc expires it.
+func (self *GitBackend) recoverRewrite(before string) error {
+
+	log.Println("Remote history was rewritten, rebasing local changes")
+
+	// Snapshot tags moved too, and fetch won't replace tags unless forced
+	err := self.git("fetch", "--tags", "--force")
+	if err != nil {
+		return err
+	}
+
+	// Exit status 1 is a conflict here, so don't use self.git
+	output, err := self.gitOutput("rebase", "--onto", "origin/master", before)
+	log.Println(output)
+	if err != nil {
+		self.git("rebase", "--abort")
+		return err
+	}
+	return nil
 }
 
 // Run: git add --all
 func (self *GitBackend) AddAll() error {
+	// Link and exclude any new variants first, so we never add their canonical name.
+	// Also copies edits of rendered templates back to the template.
+	self.updateGenerated()
 	return self.git("add", "--all")
 }
 
@@ -170,9 +268,42 @@ func (self *GitBackend) IsOnline() bool {
 	return self.git("remote", "show", "origin") == nil
 }
 
-// Check our directory is actualy a repository
+// Run: git rev-list --max-parents=0 HEAD
+// The first commit identifies the repository. 'loftus compact' never changes it.
+func (self *GitBackend) RepoId() (string, error) {
+
+	output, err := self.gitOutput("rev-list", "--max-parents=0", "HEAD")
+	if err != nil {
+		return "", err
+	}
+
+	// Merging unrelated histories gives several, the oldest is last
+	roots := strings.Fields(output)
+	if len(roots) == 0 {
+		return "", errors.New("No commits yet")
+	}
+	return roots[len(roots)-1], nil
+}
+
+// Run: git cat-file -e id^{commit}
+func (self *GitBackend) HasRevision(id string) bool {
+	_, err := self.gitOutput("cat-file", "-e", id+"^{commit}")
+	return err == nil
+}
+
+// Run: git rev-parse --verify --quiet rev^{commit}
+func (self *GitBackend) RevisionId(rev string) (string, error) {
+	output, err := self.gitOutput("rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	id := strings.TrimSpace(output)
+	if err != nil || len(id) == 0 {
+		return "", errors.New("No such commit: " + rev)
+	}
+	return id, nil
+}
+
+// Check our directory is actualy a repository, possibly a bare one
 func (self *GitBackend) Check() error {
-	err := self.git("status")
+	err := self.git("rev-parse", "--git-dir")
 	if err != nil {
 		return errors.New(self.rootDir + " is not a git repository")
 	}
@@ -188,32 +319,218 @@ func (self *GitBackend) isBehindRemote() bool {
 }
 */
 
+// Run: git log --follow --name-only --format=.. -- filename
+func (self *GitBackend) History(filename string) ([]Revision, error) {
+
+	if len(filename) == 0 {
+		return self.log()
+	}
+
+	revisions, err := self.log("--follow", "--name-only", "--", filename)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range revisions {
+		if len(revisions[i].Filename) == 0 {
+			revisions[i].Filename = filename
+		}
+	}
+	return revisions, nil
+}
+
+// Run: git log --format=.. since..HEAD
+func (self *GitBackend) Log(since string) ([]Revision, error) {
+	return self.log(since + "..HEAD")
+}
+
+// Run: git rev-parse HEAD
+func (self *GitBackend) Head() (string, error) {
+	output, err := self.gitOutput("rev-parse", "HEAD")
+	return strings.TrimSpace(output), err
+}
+
+// Run git log with args, and parse the output into revisions.
+// If args include --name-only, Revision.Filename is the first name listed.
+func (self *GitBackend) log(args ...string) ([]Revision, error) {
+
+	// Each commit starts with a record separator, and has unit separators between fields.
+	// --name-only puts filenames after the last separator.
+	format := "--format=%x1e%H%x1f%ct%x1f%an%x1f%D%x1f%B%x1f"
+	output, err := self.gitOutput("log", append([]string{format}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var revisions []Revision
+	for _, record := range strings.Split(output, "\x1e") {
+
+		fields := strings.Split(record, "\x1f")
+		if len(fields) != 6 {
+			continue
+		}
+
+		timestamp, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		summary, meta := parseCommitMsg(fields[4])
+		names := strings.Split(strings.TrimSpace(fields[5]), "\n")
+
+		rev := Revision{
+			Id:      fields[0],
+			When:    time.Unix(timestamp, 0),
+			Author:  fields[2],
+			Summary: summary,
+			Meta:    meta,
+			Snaps:   snapshotLabels(fields[3])}
+
+		if len(names[0]) != 0 {
+			rev.Filename = names[0]
+		}
+
+		revisions = append(revisions, rev)
+	}
+
+	return revisions, nil
+}
+
+// Snapshot labels from git's ref names for a commit, e.g. 'HEAD -> master, tag: snapshot/x'
+func snapshotLabels(refNames string) []string {
+	var labels []string
+	for _, ref := range strings.Split(refNames, ", ") {
+		if strings.HasPrefix(ref, "tag: "+SNAPSHOT_PREFIX) {
+			labels = append(labels, strings.TrimPrefix(ref, "tag: "+SNAPSHOT_PREFIX))
+		}
+	}
+	return labels
+}
+
+// Run: git diff rev -- filename
+// If filename was renamed since rev, compare against the old name instead.
+func (self *GitBackend) Diff(filename string, rev string) (string, error) {
+
+	oldName := self.nameAt(filename, rev)
+	if oldName == filename {
+		return self.gitOutput("diff", rev, "--", filename)
+	}
+
+	// Compares a blob with the file in the working directory
+	return self.gitOutput("diff", rev+":"+oldName, filename)
+}
+
+// Name filename had at revision rev. Different from filename if it has been renamed since.
+func (self *GitBackend) nameAt(filename string, rev string) string {
+
+	revisions, err := self.History(filename)
+	if err != nil {
+		return filename
+	}
+
+	isRenamed := false
+	for _, candidate := range revisions {
+		isRenamed = isRenamed || candidate.Filename != filename
+	}
+	if !isRenamed {
+		return filename
+	}
+
+	// The most recent change at or before rev has the name we want
+	for _, candidate := range revisions {
+		_, err = self.gitOutput("merge-base", "--is-ancestor", candidate.Id, rev)
+		if err == nil {
+			return candidate.Filename
+		}
+	}
+	return filename
+}
+
+// Run: git rev-list -1 --before=.. HEAD
+func (self *GitBackend) RevisionAt(when time.Time) (string, error) {
+
+	output, err := self.gitOutput("rev-list", "-1", "--before="+when.Format(time.RFC3339), "HEAD")
+	if err != nil {
+		return "", err
+	}
+
+	rev := strings.TrimSpace(output)
+	if len(rev) == 0 {
+		return "", errors.New("No commits before " + when.Format(time.RFC1123))
+	}
+	return rev, nil
+}
+
+// Run: git ls-tree rev -- filename ; git show rev:filename
+// A symlink's mode has os.ModeSymlink, and it's content is the link's target.
+func (self *GitBackend) FileAt(filename string, rev string) ([]byte, os.FileMode, error) {
+
+	// Output is: <mode> SP <type> SP <object> TAB <file>
+	output, err := self.gitOutput("ls-tree", rev, "--", filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(output) == 0 {
+		return nil, 0, errors.New(filename + " does not exist in revision " + rev)
+	}
+
+	var mode os.FileMode = 0644
+	switch {
+	case strings.HasPrefix(output, "100755"):
+		mode = 0755
+	case strings.HasPrefix(output, "120000"):
+		mode = os.ModeSymlink | 0777
+	}
+
+	content, err := self.gitOutput("show", rev+":"+filename)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return []byte(content), mode, nil
+}
+
 // Runs a git command, returns nil if success, error if err
 func (self *GitBackend) git(gitCmd string, args ...string) error {
-	allArgs := append([]string{gitCmd}, args...)
-	output, err := self.external.Exec(self.rootDir, self.gitPath, allArgs...)
+
+	output, err := self.gitOutput(gitCmd, args...)
 
 	if len(output) > 0 {
-		log.Println(string(output))
+		log.Println(output)
 	}
 
 	if err == nil {
 		return nil
 	}
 
-	exitStatus := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+	if err.(*GitError).status != 1 { // 1 means command had nothing to do
+		log.Println(err.(*GitError).internalError)
+		return err
+	}
+	return nil
+}
+
+// Runs a git command, returns it's standard output. Errors include stderr.
+// Unlike git(), any non-zero exit status is an error.
+func (self *GitBackend) gitOutput(gitCmd string, args ...string) (string, error) {
 
-	gitErr := &GitError{
+	allArgs := append([]string{gitCmd}, args...)
+	output, err := self.external.Exec(self.rootDir, self.gitPath, allArgs...)
+
+	if err == nil {
+		return string(output), nil
+	}
+
+	exitStatus := -1
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		exitStatus = exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+	}
+
+	return string(output), &GitError{
 		cmd:           self.gitPath + " " + strings.Join(allArgs, " "),
 		internalError: err,
-		output:        string(output),
+		output:        string(output) + errorOutput(err),
 		status:        exitStatus}
-
-	if exitStatus != 1 { // 1 means command had nothing to do
-		log.Println(err)
-		return gitErr
-	}
-	return nil
 }
 
 type GitError struct {
@@ -0,0 +1,184 @@
+// The server's set of connected clients, grouped in to a room per repository.
+//
+// One goroutine owns the rooms, and everything else talks to it over channels.
+// Each client has it's own writer goroutine with a bounded queue, so a slow
+// or stuck client is dropped instead of holding up everyone else.
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	SEND_QUEUE      = 16 // Messages waiting for a client before we give up on it
+	WRITE_TIMEOUT_S = 10
+)
+
+// A connected client
+type Peer struct {
+	conn    net.Conn
+	send    chan string // Closed by the hub when the peer leaves
+	replies chan string // Answers to the peer, e.g. pong. Never closed.
+}
+
+type outgoing struct {
+	content string
+	repo    string // Only peers subscribed to this repo get it
+	from    *Peer  // Doesn't get a copy. nil to send to everyone.
+}
+
+type subscription struct {
+	peer *Peer
+	repo string
+}
+
+type Hub struct {
+	register   chan *Peer
+	unregister chan *Peer
+	subscribe  chan subscription
+	broadcast  chan outgoing
+	count      chan chan int
+	peers      map[*Peer]bool
+	rooms      map[string]map[*Peer]bool // Repo id to subscribers
+}
+
+// Create and start a hub
+func NewHub() *Hub {
+	hub := &Hub{
+		register:   make(chan *Peer),
+		unregister: make(chan *Peer),
+		subscribe:  make(chan subscription),
+		broadcast:  make(chan outgoing),
+		count:      make(chan chan int),
+		peers:      make(map[*Peer]bool),
+		rooms:      make(map[string]map[*Peer]bool)}
+	go hub.run()
+	return hub
+}
+
+// Add conn to the hub, and start writing to it
+func (self *Hub) Join(conn net.Conn) *Peer {
+	peer := &Peer{
+		conn:    conn,
+		send:    make(chan string, SEND_QUEUE),
+		replies: make(chan string, 1)}
+	go peer.writer()
+	self.register <- peer
+	return peer
+}
+
+// Remove peer from the hub, which closes it's connection. Safe to call more than once.
+func (self *Hub) Leave(peer *Peer) {
+	self.unregister <- peer
+}
+
+// Send peer messages about repo from now on. A peer can be in many rooms.
+func (self *Hub) Subscribe(peer *Peer, repo string) {
+	self.subscribe <- subscription{peer: peer, repo: repo}
+}
+
+// Send content to every peer subscribed to repo, except 'from', which can be nil
+func (self *Hub) Broadcast(content string, repo string, from *Peer) {
+	self.broadcast <- outgoing{content: content, repo: repo, from: from}
+}
+
+// How many peers are connected
+func (self *Hub) Count() int {
+	reply := make(chan int)
+	self.count <- reply
+	return <-reply
+}
+
+// The only goroutine which touches self.peers and self.rooms
+func (self *Hub) run() {
+	for {
+		select {
+
+		case peer := <-self.register:
+			self.peers[peer] = true
+
+		case peer := <-self.unregister:
+			self.remove(peer)
+
+		case sub := <-self.subscribe:
+			if !self.peers[sub.peer] {
+				continue // Already left
+			}
+			room := self.rooms[sub.repo]
+			if room == nil {
+				room = make(map[*Peer]bool)
+				self.rooms[sub.repo] = room
+			}
+			room[sub.peer] = true
+
+		case msg := <-self.broadcast:
+			for peer := range self.rooms[msg.repo] {
+				if peer == msg.from {
+					continue
+				}
+				select {
+				case peer.send <- msg.content:
+				default:
+					log.Println("Dropping", peer.conn.RemoteAddr(), "it isn't keeping up")
+					self.remove(peer)
+				}
+			}
+
+		case reply := <-self.count:
+			reply <- len(self.peers)
+		}
+	}
+}
+
+func (self *Hub) remove(peer *Peer) {
+	if !self.peers[peer] {
+		return
+	}
+	delete(self.peers, peer)
+	for repo, room := range self.rooms {
+		delete(room, peer)
+		if len(room) == 0 {
+			delete(self.rooms, repo)
+		}
+	}
+	close(peer.send) // Writer closes the connection
+}
+
+// Send content to just this peer. Dropped if the last reply is still waiting.
+func (self *Peer) Reply(content string) {
+	select {
+	case self.replies <- content:
+	default:
+	}
+}
+
+// Write everything queued for this peer, until the hub closes the queue
+func (self *Peer) writer() {
+
+	defer self.conn.Close()
+
+	for {
+		var content string
+		var ok bool
+		select {
+		case content, ok = <-self.send:
+			if !ok {
+				return
+			}
+		case content = <-self.replies:
+		}
+
+		self.conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT_S * time.Second))
+		_, err := self.conn.Write([]byte(content))
+		if err != nil {
+			log.Println("Error writing to", self.conn.RemoteAddr(), err)
+			// Closing makes the reader fail, so handle unregisters us
+			self.conn.Close()
+			for range self.send {
+			}
+			return
+		}
+	}
+}
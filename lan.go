@@ -0,0 +1,199 @@
+// Sync over the local network, by UDP multicast.
+//
+// Every client joins the same groups (--lan-group, IPv4 and/or IPv6) and
+// announces changes to them. Packets carry the sender's id, so we can
+// ignore our own, which multicast loops back to us.
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"syscall"
+)
+
+const (
+	DEFAULT_LAN_GROUP = "239.255.76.67:51234" // Administratively scoped, i.e. stays on our network
+	LAN_PACKET_SIZE   = 1500
+)
+
+type LanNotifier struct {
+	groups    []*net.UDPAddr
+	ifi       *net.Interface // nil for the system's choice
+	sender    string         // Ours, to ignore our own announcements
+	listeners []*net.UDPConn
+}
+
+// groups is a comma separated list of multicast address:port.
+// iface is the name of the network interface to use, empty for the default.
+func NewLanNotifier(groups string, iface string, sender string) (*LanNotifier, error) {
+
+	notifier := &LanNotifier{sender: sender}
+
+	for _, group := range strings.Split(groups, ",") {
+		addr, err := net.ResolveUDPAddr("udp", strings.TrimSpace(group))
+		if err != nil {
+			return nil, errors.New("LAN group " + group + ": " + err.Error())
+		}
+		if !addr.IP.IsMulticast() {
+			return nil, errors.New("LAN group " + group + " is not a multicast address")
+		}
+		notifier.groups = append(notifier.groups, addr)
+	}
+
+	if len(iface) != 0 {
+		ifi, err := net.InterfaceByName(iface)
+		if err != nil {
+			return nil, errors.New("LAN interface " + iface + ": " + err.Error())
+		}
+		notifier.ifi = ifi
+	}
+
+	return notifier, nil
+}
+
+// Send msg to every group
+func (self *LanNotifier) Announce(msg *Message) error {
+
+	var errs []string
+	for _, group := range self.groups {
+		err := self.send(group, []byte(msg.Encode()))
+		if err != nil {
+			errs = append(errs, "LAN announce to "+group.String()+": "+err.Error())
+		}
+	}
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, ". "))
+	}
+	log.Println("LAN announcement sent")
+	return nil
+}
+
+func (self *LanNotifier) send(group *net.UDPAddr, content []byte) error {
+
+	network := "udp4"
+	if group.IP.To4() == nil {
+		network = "udp6"
+	}
+
+	sock, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return err
+	}
+	defer sock.Close()
+
+	if self.ifi != nil {
+		err = self.setSendInterface(sock, network)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = sock.WriteToUDP(content, group)
+	return err
+}
+
+// Send multicast from our chosen interface, instead of the one with the default route
+func (self *LanNotifier) setSendInterface(sock *net.UDPConn, network string) error {
+
+	var ifAddr [4]byte
+	if network == "udp4" {
+		addrs, err := self.ifi.Addrs()
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if ok && ipNet.IP.To4() != nil {
+				copy(ifAddr[:], ipNet.IP.To4())
+				break
+			}
+		}
+	}
+
+	raw, err := sock.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if network == "udp4" {
+			sockErr = syscall.SetsockoptInet4Addr(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, ifAddr)
+		} else {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, self.ifi.Index)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// Join every group, and put what others announce on channel.
+// Groups we can't join are reported, but don't stop the others.
+func (self *LanNotifier) Subscribe(channel chan *Message) error {
+
+	var errs []string
+	for _, group := range self.groups {
+
+		network := "udp4"
+		if group.IP.To4() == nil {
+			network = "udp6"
+		}
+
+		listener, err := net.ListenMulticastUDP(network, self.ifi, group)
+		if err != nil {
+			errs = append(errs, "LAN listen on "+group.String()+": "+err.Error())
+			continue
+		}
+		self.listeners = append(self.listeners, listener)
+		go self.listen(listener, channel)
+	}
+
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, ". "))
+	}
+	return nil
+}
+
+func (self *LanNotifier) listen(listener *net.UDPConn, channel chan *Message) {
+
+	buf := make([]byte, LAN_PACKET_SIZE)
+	for {
+		n, from, err := listener.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Println("LAN read error:", err)
+			continue
+		}
+
+		msg, err := decodeMessage(string(buf[:n]))
+		if err != nil {
+			log.Println("LAN", from, err)
+			continue
+		}
+		if msg.Sender == self.sender {
+			continue // Our own, looped back
+		}
+		if strings.HasPrefix(msg.Peer, ":") {
+			// Sender gives the port, the packet tells us the address
+			msg.Peer = net.JoinHostPort(from.IP.String(), msg.Peer[1:])
+		}
+		log.Println("LAN msg received from", from, string(buf[:n]))
+		channel <- msg
+	}
+}
+
+func (self *LanNotifier) Close() error {
+	var lastErr error
+	for _, listener := range self.listeners {
+		err := listener.Close()
+		if err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
 
 const (
+	VERSION = "0.2"
+
 	DEFAULT_SYNC_DIR = "/loftus"
 	SYNC_IDLE_SECS   = 5
 
@@ -17,6 +23,21 @@ const (
 
 	SUGGEST_CMD_ALERT = "#!/bin/bash\nzenity --warning --title=loftus --text=\"$1\""
 	SUGGEST_CMD_INFO  = "#!/bin/bash\nnotify-send loftus \"$1\""
+
+	// What made us sync, recorded in the commit
+	TRIGGER_STARTUP   = "Startup sync"
+	TRIGGER_INCOMING  = "Incoming"
+	TRIGGER_WATCH     = "Watch"
+	TRIGGER_RECONNECT = "Reconnect"
+	TRIGGER_CONTROL   = "Requested" // loftus ctl sync
+	TRIGGER_RESUME    = "Resume"    // Everything that changed while paused
+
+	// Commit message trailers
+	TRAILER_HOST    = "Loftus-Host"
+	TRAILER_USER    = "Loftus-User"
+	TRAILER_VERSION = "Loftus-Version"
+	TRAILER_TRIGGER = "Loftus-Trigger"
+	TRAILER_EVENTS  = "Loftus-Events"
 )
 
 type Storage interface {
@@ -24,6 +45,15 @@ type Storage interface {
 	// Perform all possible sanity checks, returning a user-helpful error
 	Check() error
 
+	// Identifies the repository, the same for every client
+	RepoId() (string, error)
+
+	// Do we already have this revision?
+	HasRevision(id string) bool
+
+	// Full identifier of rev, which can be abbreviated. Error if there's no such revision.
+	RevisionId(rev string) (string, error)
+
 	// Can we contact remote storage server (i.e. git remote)
 	IsOnline() bool
 
@@ -36,30 +66,154 @@ type Storage interface {
 	// Commit files to storage
 	Commit(string) error
 
+	// Identifier of the current revision
+	Head() (string, error)
+
+	// Revisions after since, up to and including the current one, newest first
+	Log(since string) ([]Revision, error)
+
 	// Send files to remote storage server
 	Push() error
+
+	// Bring in changes directly from another loftus at addr, see peer.go
+	PullPeer(addr string) error
+
+	// Revisions which changed filename, newest first. Follows renames.
+	// Empty filename means every revision.
+	History(filename string) ([]Revision, error)
+
+	// Differences between filename at revision rev and it's current contents
+	Diff(filename string, rev string) (string, error)
+
+	// Identifier of the revision which was current at the given time
+	RevisionAt(when time.Time) (string, error)
+
+	// Contents and permissions of filename as it was at revision rev
+	FileAt(filename string, rev string) ([]byte, os.FileMode, error)
+
+	// Squash old revisions as policy says, returning how many were removed
+	Compact(policy RetentionPolicy) (int, error)
+
+	// Label the current revision, so we can get back to it
+	Snapshot(name string) error
+
+	// All snapshots, oldest first
+	Snapshots() ([]Snapshot, error)
+
+	// Make the directory look like it did at a snapshot
+	Rollback(name string) error
+}
+
+// Tells other loftus instances about changes, and hears about theirs
+type Notifier interface {
+
+	// Tell everyone else
+	Announce(msg *Message) error
+
+	// Put messages from everyone else on channel, from now on
+	Subscribe(channel chan *Message) error
+
+	// Stop sending and receiving
+	Close() error
+}
+
+// A single change in storage
+type Revision struct {
+	Id       string
+	When     time.Time
+	Author   string
+	Summary  string // Usually from commitMsg
+	Filename string // Name of the file at this revision, which changes on rename
+	Meta     CommitMeta
+	Snaps    []string // Labels of snapshots taken at this revision
+}
+
+// Where a commit came from. Stored as trailers in the commit message.
+type CommitMeta struct {
+	Host    string
+	User    string
+	Version string
+	Trigger string
+	Events  int
 }
 
 type Config struct {
 	isServer   bool
 	isCheck    bool
+	isDeploy   bool
+	isTls      bool
+	isMdns     bool
+	isPeer     bool
+	peerPort   int
 	serverAddr string
+	socketPath string
+	ctlPath    string
+	secretFile string
+	tlsCert    string
+	tlsKey     string
+	tlsCa      string
+	remoteRepo string
+	heartbeat  Heartbeat
+	lanGroups  string
+	lanIface   string
 	syncDir    string
+	hostName   string
+	vars       TemplateVars
+	command    string
+	args       []string
+	at         string
+	commit     string
+	keep       string
+
+	isInstallKey bool
+	pauseTimeout time.Duration
 }
 
 type Client struct {
 	backend  Storage
 	watch    chan Event
 	external External
-	incoming chan string
+	incoming chan *Message
+	notifier Notifier
 	isOnline bool
+	hostName string
+	userName string
+	deployer *Deployer // nil unless --deploy
+	syncDir  string
+	senderId string // Identifies our own messages
+	repoId   string
+	states   chan ConnState // Connection to the server
+	conn     ConnState
+
+	serverAddr        string                                          // Configured, or found with mDNS. Empty if neither.
+	newServerNotifier func(addr string, isTls bool) (Notifier, error) // Connects to a server we found
+	found             chan Service                                    // From mDNS. nil unless --mdns.
+	trustsFound       bool                                            // A server found with mDNS can prove itself, see discovered
+	isTls             bool                                            // Only connect to servers with TLS
+	peerPort          int                                             // Where we serve peers. 0 unless --peer.
+	peers             map[string]Service                              // By mDNS instance name
+
+	control   chan *ctlCall // From 'loftus ctl'. nil if we couldn't listen.
+	pending   []Event       // Watcher events not synced yet
+	lastSync  time.Time
+	lastError string     // Why the last sync failed. Empty if it worked.
+	activity  []Activity // Most recent last, see record
+
+	paused       bool // Sync does nothing until resumed, see pause.go
+	pausedAt     time.Time
+	pausedUntil  time.Time        // Zero unless we'll resume by ourselves
+	autoResume   <-chan time.Time // Fires at pausedUntil. nil if it's zero.
+	pauseTimeout time.Duration    // For a pause by signal. 0 for none.
+	signals      chan os.Signal   // Pause and resume
 }
 
 func main() {
 
 	config := confFromFlags()
 
-	if config.isServer {
+	if len(config.command) != 0 {
+		runCommand(config)
+	} else if config.isServer {
 		log.Println("Server mode")
 		startServer(config)
 	} else {
@@ -68,7 +222,8 @@ func main() {
 	}
 }
 
-// Parse commands line flags in to a configuration object
+// Parse commands line flags in to a configuration object.
+// Anything which isn't a flag is a command (e.g. restore) and it's arguments.
 func confFromFlags() *Config {
 
 	defaultSync := os.Getenv("HOME") + DEFAULT_SYNC_DIR
@@ -77,18 +232,143 @@ func confFromFlags() *Config {
 		defaultSync,
 		"Synchronise this directory. Must already be a git repo with a remote (i.e. 'git pull' works)")
 
+	defaultHost, _ := os.Hostname()
+	var hostName = flag.String(
+		"host",
+		defaultHost,
+		"Name of this machine, recorded in every commit")
+
+	vars := make(TemplateVars)
+	flag.Var(&vars, "var", "name=value variable for templates. Repeat for more.")
+
 	var isServer = flag.Bool("server", false, "Be the server")
+	var isDeploy = flag.Bool(
+		"deploy",
+		false,
+		"Keep files deployed to their targets, as listed in "+DEPLOY_MANIFEST+". See 'loftus deploy'.")
 	var serverAddr = flag.String(
 		"address",
 		"",
 		"address:port where server is listening. e.g. an.example.com:8007")
+	var socketPath = flag.String(
+		"socket",
+		defaultSocket("loftus-server"),
+		"Server: unix socket which the git post-receive hook notifies")
+	var ctlPath = flag.String(
+		"control",
+		defaultSocket("loftus"),
+		"Client: unix socket which 'loftus ctl' talks to")
+	var secretFile = flag.String(
+		"secret-file",
+		defaultSecretFile(),
+		"File containing a secret shared by the server and all clients. Clients must know it to connect.")
+	var heartbeat = flag.Duration(
+		"heartbeat",
+		DEFAULT_HEARTBEAT,
+		"Client: How often to check the connection to the server is alive")
+	var heartbeatTimeout = flag.Duration(
+		"heartbeat-timeout",
+		DEFAULT_HEARTBEAT_TIMEOUT,
+		"Drop a connection after this long without hearing anything. Server's must be longer than clients' --heartbeat.")
+	var pauseTimeout = flag.Duration(
+		"pause-timeout",
+		0,
+		"Client: resume by itself this long after being paused by a signal. 0 waits for resume.")
+	var lanGroups = flag.String(
+		"lan-group",
+		DEFAULT_LAN_GROUP,
+		"Multicast address:port for announcements on the local network. Comma separate several, e.g. to add IPv6 [ff02::4c46]:51234")
+	var lanIface = flag.String("lan-interface", "", "Network interface for local network announcements. Default is the system's choice.")
+	var isMdns = flag.Bool(
+		"mdns",
+		false,
+		"Advertise ourselves, and find others (including a server if there's no --address, and we share a secret or --tls-ca with it), on the local network with mDNS")
+	var isPeer = flag.Bool(
+		"peer",
+		false,
+		"Sync directly with other clients on the local network, no server needed. Needs a shared secret.")
+	var peerPort = flag.Int("peer-port", DEFAULT_PEER_PORT, "Port to serve our repository to peers on, with --peer")
+	var isTls = flag.Bool("tls", false, "Encrypt the connection between clients and server. Both must use it.")
+	var tlsCert = flag.String("tls-cert", "", "Server, and clients with --peer: TLS certificate file. Default is a self-signed one we make.")
+	var tlsKey = flag.String("tls-key", "", "Server, and clients with --peer: TLS private key file, for --tls-cert")
+	var tlsCa = flag.String(
+		"tls-ca",
+		"",
+		"Client: Verify the server with this CA certificate file. Default is to trust the first certificate we see.")
 
+	var at = flag.String(
+		"at",
+		"",
+		"restore: Time to restore from. e.g. '2013-05-21 14:30' or '3h' for three hours ago")
+	var commit = flag.String("commit", "", "restore: Commit id to restore from")
+	var keep = flag.String(
+		"keep",
+		DEFAULT_RETENTION,
+		"compact: Retention policy, <max age>:<keep one per>,... Default keeps all for a week, hourly for a month, then daily")
+
+	var remoteRepo = flag.String("remote-repo", DEFAULT_REMOTE, "join: Path of the git repository on the server")
+	var isInstallKey = flag.Bool(
+		"install-key",
+		false,
+		"join: Install our public key on the server with ssh-copy-id. Needs password login.")
+
+	// Flags can come before or after the command and it's arguments
+	var args []string
 	flag.Parse()
+	for flag.NArg() != 0 {
+		args = append(args, flag.Arg(0))
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
 
-	return &Config{
+	config := &Config{
 		isServer:   *isServer,
+		isDeploy:   *isDeploy,
+		isTls:      *isTls,
+		isMdns:     *isMdns,
+		isPeer:     *isPeer,
+		peerPort:   *peerPort,
 		serverAddr: *serverAddr,
-		syncDir:    *syncDir}
+		socketPath: *socketPath,
+		ctlPath:    *ctlPath,
+		secretFile: *secretFile,
+		tlsCert:    *tlsCert,
+		tlsKey:     *tlsKey,
+		tlsCa:      *tlsCa,
+		remoteRepo: *remoteRepo,
+		heartbeat:  Heartbeat{Interval: *heartbeat, Timeout: *heartbeatTimeout},
+		lanGroups:  *lanGroups,
+		lanIface:   *lanIface,
+		syncDir:    *syncDir,
+		hostName:   *hostName,
+		vars:       vars,
+		at:         *at,
+		commit:     *commit,
+		keep:       *keep,
+
+		isInstallKey: *isInstallKey,
+		pauseTimeout: *pauseTimeout}
+
+	if len(args) != 0 {
+		config.command = args[0]
+		config.args = args[1:]
+	}
+
+	err := config.heartbeat.Check()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return config
+}
+
+// Path for a unix socket, in the user's runtime directory if they have one
+func defaultSocket(name string) string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if len(dir) == 0 {
+		dir = os.TempDir()
+		name += "-" + strconv.Itoa(os.Getuid())
+	}
+	return filepath.Join(dir, name+".sock")
 }
 
 // Watch directories, called sync methods on syncer, etc
@@ -109,7 +389,7 @@ func startClient(config *Config) {
 		log.Fatal(err)
 	}
 
-	incomingChannel := make(chan string)
+	incomingChannel := make(chan *Message)
 
 	client := Client{
 		backend:  backend,
@@ -117,10 +397,103 @@ func startClient(config *Config) {
 		external: external,
 		incoming: incomingChannel,
 		isOnline: true,
+		hostName: config.hostName,
+		userName: os.Getenv("USER"),
+		syncDir:  syncDir,
+		senderId: newSenderId(),
+	}
+
+	if config.isDeploy {
+		client.deployer = NewDeployer(syncDir)
+	}
+
+	lan, err := NewLanNotifier(config.lanGroups, config.lanIface, client.senderId)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Connects to the server, whether configured or found with mDNS
+	secret := config.loadSecret()
+	client.states = make(chan ConnState)
+	client.newServerNotifier = func(addr string, isTls bool) (Notifier, error) {
+		var tlsConf *tls.Config
+		if isTls {
+			var err error
+			tlsConf, err = clientTlsConfig(config, addr)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return NewTcpNotifier(
+			addr,
+			tlsConf,
+			secret,
+			client.senderId,
+			client.getRepoId(),
+			config.heartbeat,
+			client.states), nil
+	}
+	client.isTls = config.isTls
+	client.trustsFound = len(secret) != 0 || (config.isTls && len(config.tlsCa) != 0)
+
+	notifiers := MultiNotifier{lan}
+	if len(config.serverAddr) != 0 {
+		client.serverAddr = config.serverAddr
+		server, err := client.newServerNotifier(config.serverAddr, config.isTls)
+		if err != nil {
+			log.Fatal(err)
+		}
+		notifiers = append(notifiers, server)
+	}
+	client.notifier = notifiers
+
+	err = client.notifier.Subscribe(incomingChannel)
+	if err != nil {
+		log.Println(err)
+	}
+	defer client.notifier.Close()
+
+	if config.isPeer {
+		// Peers fetch the whole repository, so it's as private as the server's connection
+		peerTls, err := serverTlsConfig(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		peerServer, err := NewPeerServer(syncDir, config.peerPort, secret, peerTls)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer peerServer.Close()
+		client.peerPort = peerServer.Port()
+	}
+
+	if config.isMdns {
+		client.found = make(chan Service)
+		mdns := NewMdns(config.hostName, client.peerPort, map[string]string{
+			"v":      strconv.Itoa(PROTOCOL_VERSION),
+			"role":   ROLE_CLIENT,
+			"repo":   client.getRepoId(),
+			"sender": client.senderId})
+		err = mdns.Start(client.found)
+		if err != nil {
+			log.Println(err)
+		}
+		defer mdns.Close()
 	}
 
-	go udpListen(incomingChannel)
-	go tcpListen(config.serverAddr, incomingChannel)
+	client.control = make(chan *ctlCall)
+	ctlServer, err := NewControlServer(config.ctlPath, client.control)
+	if err != nil {
+		log.Println("Control socket:", err)
+		client.control = nil
+	} else {
+		defer ctlServer.Close()
+	}
+
+	client.pauseTimeout = config.pauseTimeout
+	client.signals = make(chan os.Signal, 1)
+	signal.Notify(client.signals, SIGNAL_PAUSE, SIGNAL_RESUME)
+
 	client.run()
 }
 
@@ -128,39 +501,174 @@ func startClient(config *Config) {
 func (self *Client) run() {
 
 	// Always start with a sync to bring us up to date
-	err := self.Sync("Startup sync")
+	err := self.Sync(TRIGGER_STARTUP, nil)
 	if err != nil {
 		self.warn(err.Error())
 	}
 
-	events := make([]Event, 0, 1)
+	// A nil channel never fires, so no deploy checks unless asked for
+	var deployTick <-chan time.Time
+	if self.deployer != nil {
+		self.deploy()
+		deployTick = time.Tick(DEPLOY_CHECK_SECS * time.Second)
+	}
 
 	for {
 		select {
 
 		case event := <-self.watch:
-			events = append(events, event)
+			self.pending = append(self.pending, event)
 
-		case <-self.incoming:
+		case msg := <-self.incoming:
+			if !self.isSyncNeeded(msg) {
+				continue
+			}
 			log.Println("Remote update notification")
-			self.Sync("Incoming")
+			before, _ := self.backend.Head()
+			self.Sync(TRIGGER_INCOMING, nil)
+			if len(msg.Peer) != 0 && self.peerPort != 0 {
+				self.pullPeer(msg.Peer)
+			}
+			self.infoIncoming(msg, before)
+			if self.deployer != nil {
+				self.deploy()
+			}
 
-		case <-time.After(SYNC_IDLE_SECS * time.Second):
+		case state := <-self.states:
+			self.connChanged(state)
+
+		case service := <-self.found:
+			self.discovered(service)
+
+		case call := <-self.control:
+			call.reply <- self.handleControl(call.request)
 
-			if len(events) != 0 {
+		case sig := <-self.signals:
+			self.signalled(sig)
 
-				self.Sync(commitMsg(events))
-				if self.isOnline {
-					self.broadcast()
-				}
+		case <-self.autoResume:
+			err := self.resume()
+			if err != nil {
+				log.Println(err)
+			}
+
+		case <-deployTick:
+			self.deploy()
+
+		case <-time.After(SYNC_IDLE_SECS * time.Second):
 
-				events = make([]Event, 0, 1)
+			if len(self.pending) != 0 && !self.paused {
+				self.syncPending(TRIGGER_WATCH)
 			}
 		}
 	}
 
 }
 
+// Commit the watcher's events, and tell everyone
+func (self *Client) syncPending(trigger string) error {
+
+	events := self.pending
+	self.pending = nil
+
+	err := self.Sync(trigger, events)
+	if self.isOnline {
+		self.broadcast(events)
+	}
+	return err
+}
+
+// The connection to the server went up or down.
+// We missed any updates while it was down, so catch up.
+func (self *Client) connChanged(state ConnState) {
+
+	previous := self.conn
+	self.conn = state
+	if state.State != CONN_CONNECTED || len(previous.State) == 0 {
+		return // Startup sync covers the first connection
+	}
+
+	self.info("Reconnected to sync server")
+	self.record("Reconnected to sync server")
+	err := self.Sync(TRIGGER_RECONNECT, nil)
+	if err != nil {
+		log.Println(err)
+	}
+	if self.deployer != nil {
+		self.deploy()
+	}
+}
+
+// mDNS told us about another loftus. Remember it for status, and connect
+// if it's a server and we don't have one.
+//
+// Anyone on the network can claim to be a server, so we only connect if
+// it can prove it's ours: by knowing our shared secret, or with a
+// certificate from --tls-ca.
+func (self *Client) discovered(service Service) {
+
+	if self.peers == nil {
+		self.peers = make(map[string]Service)
+	}
+
+	if !service.Expires.After(time.Now()) {
+		if _, ok := self.peers[service.Instance]; ok {
+			log.Println("mDNS:", service.Name(), "left")
+			delete(self.peers, service.Instance)
+		}
+		return
+	}
+
+	_, isKnown := self.peers[service.Instance]
+	self.peers[service.Instance] = service
+	if isKnown {
+		return
+	}
+
+	role := service.Txt["role"]
+	log.Println("mDNS: found", role, service.Name(), "at", service.Addr())
+
+	// It may have changed things while we weren't looking
+	isPeer := role == ROLE_CLIENT && service.Port != 0 && service.Txt["repo"] == self.getRepoId()
+	if isPeer && self.peerPort != 0 && len(service.Addr()) != 0 {
+		before, _ := self.backend.Head()
+		self.pullPeer(service.Addr())
+		self.infoRemoteChanges(before)
+	}
+
+	if role != ROLE_SERVER || len(self.serverAddr) != 0 || len(service.Addr()) == 0 {
+		return
+	}
+
+	if !self.trustsFound {
+		log.Println("mDNS: not connecting to", service.Name(),
+			"because we couldn't tell it from an impostor. Use --secret-file or --tls-ca, or give --address.")
+		return
+	}
+
+	// We use TLS if it offers it. If we insist on TLS it must.
+	isTls := service.Txt["tls"] == "1"
+	if self.isTls && !isTls {
+		log.Println("mDNS: not connecting to", service.Name(), "because it doesn't offer TLS")
+		return
+	}
+
+	server, err := self.newServerNotifier(service.Addr(), isTls)
+	if err != nil {
+		log.Println("mDNS: not connecting to", service.Name(), err)
+		return
+	}
+
+	self.serverAddr = service.Addr()
+	self.info("Found loftus server " + service.Name() + " at " + self.serverAddr)
+
+	err = server.Subscribe(self.incoming)
+	if err != nil {
+		log.Println(err)
+	}
+	self.notifier = MultiNotifier{self.notifier, server}
+}
+
 // Format the underlying events into a nice commit message
 func commitMsg(events []Event) string {
 
@@ -187,12 +695,94 @@ func commitMsg(events []Event) string {
 	return strings.Join(msgs, ". ")
 }
 
+// The files events are about, relative to syncDir, each once, in order
+func changedPaths(syncDir string, events []Event) []string {
+
+	var paths []string
+	seen := make(map[string]bool)
+	for _, event := range events {
+		path := event.Filename
+		rel, err := filepath.Rel(syncDir, path)
+		if err == nil && len(syncDir) != 0 {
+			path = filepath.ToSlash(rel)
+		}
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// Add metadata trailers to a commit message, so we know where it came from
+func (self CommitMeta) Format(summary string) string {
+
+	trailers := []string{
+		TRAILER_HOST + ": " + self.Host,
+		TRAILER_USER + ": " + self.User,
+		TRAILER_VERSION + ": " + self.Version,
+		TRAILER_TRIGGER + ": " + self.Trigger,
+		TRAILER_EVENTS + ": " + strconv.Itoa(self.Events),
+	}
+
+	return summary + "\n\n" + strings.Join(trailers, "\n")
+}
+
+// Split a commit message into it's summary line and loftus metadata.
+// Commits made by other tools have empty metadata.
+func parseCommitMsg(msg string) (string, CommitMeta) {
+
+	var meta CommitMeta
+	lines := strings.Split(strings.TrimSpace(msg), "\n")
+
+	for _, line := range lines[1:] {
+
+		lineParts := strings.SplitN(line, ": ", 2)
+		if len(lineParts) != 2 {
+			continue
+		}
+
+		value := strings.TrimSpace(lineParts[1])
+		switch lineParts[0] {
+		case TRAILER_HOST:
+			meta.Host = value
+		case TRAILER_USER:
+			meta.User = value
+		case TRAILER_VERSION:
+			meta.Version = value
+		case TRAILER_TRIGGER:
+			meta.Trigger = value
+		case TRAILER_EVENTS:
+			meta.Events, _ = strconv.Atoi(value)
+		}
+	}
+
+	return lines[0], meta
+}
+
 // Run: git pull; git add --all ; git commit --all; git push
-func (self *Client) Sync(commitMsg string) error {
+// trigger is what caused the sync, and events are the file changes, if any.
+func (self *Client) Sync(trigger string, events []Event) (err error) {
+
+	if self.paused {
+		log.Println("Paused, not syncing:", trigger)
+		return nil
+	}
 
 	log.Println("* Sync start")
 
-	var err error
+	// For 'loftus ctl status' and 'activity'
+	defer func() {
+		if err != nil {
+			self.lastError = err.Error()
+			self.record("Sync failed: " + err.Error())
+			return
+		}
+		self.lastSync = time.Now()
+		self.lastError = ""
+		self.record("Synced (" + trigger + "), events: " + strconv.Itoa(len(events)))
+	}()
 
 	isOnline := self.backend.IsOnline()
 	if isOnline != self.isOnline {
@@ -209,12 +799,19 @@ func (self *Client) Sync(commitMsg string) error {
 	}
 
 	if self.isOnline {
+		before, _ := self.backend.Head()
+
 		// Pull first to ensure a fast-forward when we push
 		err = self.backend.Pull()
 		if err != nil {
 			log.Println("Returning error from Pull")
 			return err
 		}
+
+		// An update notification says what changed better, see infoIncoming
+		if trigger != TRIGGER_INCOMING {
+			self.infoRemoteChanges(before)
+		}
 	}
 
 	err = self.backend.AddAll()
@@ -222,7 +819,22 @@ func (self *Client) Sync(commitMsg string) error {
 		return err
 	}
 
-	self.backend.Commit(commitMsg)
+	summary := trigger
+	if trigger == TRIGGER_RESUME {
+		summary = self.resumeMsg(events)
+	} else if len(events) != 0 {
+		summary = commitMsg(events)
+	}
+
+	meta := CommitMeta{
+		Host:    self.hostName,
+		User:    self.userName,
+		Version: VERSION,
+		Trigger: trigger,
+		Events:  len(events),
+	}
+
+	err = self.backend.Commit(meta.Format(summary))
 	if err != nil {
 		return err
 	}
@@ -238,13 +850,108 @@ func (self *Client) Sync(commitMsg string) error {
 	return nil
 }
 
-// Tell other loftus instances to update themselves, because something changed.
-func (self *Client) broadcast() {
-	msg := "Updated\n"
-	if remoteConn != nil { // remoteConn is global in comms.go
-		tcpSend(remoteConn, msg)
+// Tell the user what other machines changed since revision 'before'
+func (self *Client) infoRemoteChanges(before string) {
+
+	if len(before) == 0 {
+		return
+	}
+
+	revisions, err := self.backend.Log(before)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	var msgs []string
+	for _, rev := range revisions {
+		if len(rev.Meta.Host) == 0 || rev.Meta.Host == self.hostName {
+			continue
+		}
+		msgs = append(msgs, rev.Meta.Host+": "+rev.Summary)
+	}
+
+	if len(msgs) != 0 {
+		self.info(strings.Join(msgs, "\n"))
+	}
+}
+
+// Tell the user what the update notification msg brought in, now that
+// it's merged. Nothing if we already had it.
+func (self *Client) infoIncoming(msg *Message, before string) {
+
+	after, _ := self.backend.Head()
+	if after == before {
+		return
+	}
+
+	if len(msg.Paths) == 0 {
+		// From an older loftus, or not about a file change. Ask git instead.
+		self.infoRemoteChanges(before)
+		return
+	}
+	self.info(msg.Describe())
+	self.record(msg.Describe())
+}
+
+// Repair deployed files, telling the user about any we had to adopt.
+// Adopted files change the sync dir, so the watcher will commit them.
+func (self *Client) deploy() {
+
+	adopted, err := self.deployer.Deploy()
+	if err != nil {
+		log.Println(err)
+	}
+
+	if len(adopted) != 0 {
+		self.info("Replaced by a real file, copied back in to loftus: " + strings.Join(adopted, ", "))
+	}
+}
+
+// Should this message from the server or LAN make us sync?
+func (self *Client) isSyncNeeded(msg *Message) bool {
+
+	switch {
+	case msg.Sender == self.senderId:
+		return false
+	case msg.Type != MSG_UPDATE:
+		return false
+	case len(msg.Repo) != 0 && msg.Repo != self.getRepoId():
+		log.Println("Ignoring update for another repository", msg.Repo)
+		return false
+	case len(msg.Head) != 0 && self.backend.HasRevision(msg.Head):
+		log.Println("Already have", msg.Head)
+		return false
+	}
+	return true
+}
+
+// Our repository's id. A new repository doesn't have one until the first commit.
+func (self *Client) getRepoId() string {
+	if len(self.repoId) == 0 {
+		self.repoId, _ = self.backend.RepoId()
+	}
+	return self.repoId
+}
+
+// Tell other loftus instances to update themselves, because events changed things.
+func (self *Client) broadcast(events []Event) {
+
+	head, err := self.backend.Head()
+	if err != nil {
+		log.Println(err)
+	}
+
+	msg := NewMessage(MSG_UPDATE, self.getRepoId(), self.senderId, head)
+	msg.Host = self.hostName
+	if self.peerPort != 0 {
+		msg.Peer = ":" + strconv.Itoa(self.peerPort) // Receivers know our address
+	}
+	msg.SetPaths(changedPaths(self.syncDir, events))
+	err = self.notifier.Announce(msg)
+	if err != nil {
+		log.Println(err)
 	}
-	udpSend(msg)
 }
 
 // Utility function to warn user about something - for example a git error
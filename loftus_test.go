@@ -1,9 +1,22 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestMainLoop(t *testing.T) {
@@ -17,14 +30,17 @@ func TestMainLoop(t *testing.T) {
 	backend := NewGitBackend(config, external)
 
 	watchChannel := make(chan Event)
-	incomingChannel := make(chan string)
+	incomingChannel := make(chan *Message)
 
 	client := Client{
 		backend:  backend,
 		watch:    watchChannel,
 		external: external,
 		incoming: incomingChannel,
+		notifier: &MockNotifier{},
 		isOnline: true,
+		hostName: "laptop",
+		userName: "graham",
 	}
 
 	go client.run()
@@ -34,23 +50,1649 @@ func TestMainLoop(t *testing.T) {
 
 	expected := []string{
 		"/usr/bin/git remote show origin",
+		"/usr/bin/git rev-parse HEAD",
+		"/usr/bin/git rev-parse --verify --quiet " + LAST_REMOTE_REF,
 		"/usr/bin/git fetch",
 		"/usr/bin/git merge origin/master",
+		"/usr/bin/git update-ref " + LAST_REMOTE_REF + " origin/master",
 		"/usr/bin/git add --all",
-		"/usr/bin/git commit --all --message=Startup sync",
-		"/usr/bin/git push",
+		"/usr/bin/git commit --all --message=Startup sync\n\n" +
+			"Loftus-Host: laptop\nLoftus-User: graham\nLoftus-Version: " + VERSION + "\n" +
+			"Loftus-Trigger: Startup sync\nLoftus-Events: 0",
+		"/usr/bin/git push --follow-tags",
 	}
 	if fmt.Sprintf("%v", external.cmds) != fmt.Sprintf("%v", expected) {
 		t.Error("Unexpected exec: ", external.cmds)
 	}
 }
 
+func TestBroadcast(t *testing.T) {
+
+	lan, server := &MockNotifier{}, &MockNotifier{}
+	client := Client{
+		backend:  NewGitBackend(&Config{syncDir: "/tmp/fake"}, &MockExternal{}),
+		notifier: MultiNotifier{lan, server},
+		hostName: "laptop",
+		syncDir:  "/tmp/fake",
+		senderId: "sender1",
+		repoId:   "repo1",
+	}
+
+	client.broadcast([]Event{
+		{"/tmp/fake/.vimrc", "Edit"},
+		{"/tmp/fake/bin/backup", "Create"},
+		{"/tmp/fake/.vimrc", "Edit"},
+	})
+
+	for _, notifier := range []*MockNotifier{lan, server} {
+		if len(notifier.announced) != 1 {
+			t.Fatal("Expected one announcement, got", notifier.announced)
+		}
+		msg := notifier.announced[0]
+		if msg.Type != MSG_UPDATE || msg.Repo != "repo1" || msg.Sender != "sender1" {
+			t.Error("Unexpected announcement:", msg)
+		}
+		if msg.Host != "laptop" || fmt.Sprint(msg.Paths) != "[.vimrc bin/backup]" {
+			t.Error("Announcement should say who changed what:", msg.Host, msg.Paths)
+		}
+	}
+}
+
+func TestControl(t *testing.T) {
+
+	external := &MockExternal{}
+	client := Client{
+		backend:   NewGitBackend(&Config{syncDir: "/tmp/fake"}, external),
+		external:  external,
+		notifier:  &MockNotifier{},
+		syncDir:   "/tmp/fake",
+		isOnline:  true,
+		pending:   []Event{{"/tmp/fake/.vimrc", "Edit"}},
+		lastError: "Pull failed",
+	}
+
+	path := filepath.Join(t.TempDir(), "ctl.sock")
+	calls := make(chan *ctlCall)
+	server, err := NewControlServer(path, calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// Stands in for the main loop
+	go func() {
+		for call := range calls {
+			call.reply <- client.handleControl(call.request)
+		}
+	}()
+
+	request := func(command string) CtlResponse {
+		var response CtlResponse
+		answer, err := ctlRequest(path, command)
+		if err == nil {
+			err = json.Unmarshal(answer, &response)
+		}
+		if err != nil {
+			t.Fatal(command, err)
+		}
+		return response
+	}
+
+	status := request(CTL_STATUS).Status
+	if status == nil || !status.Online || status.Paused || status.Pending != 1 || status.Dir != "/tmp/fake" ||
+		status.LastError != "Pull failed" {
+		t.Error("Unexpected status:", status)
+	}
+
+	status = request(CTL_SYNC).Status
+	if status == nil || status.Pending != 0 || status.LastSync == nil || status.LastError != "" {
+		t.Error("Sync should commit pending events, and clear the last error:", status)
+	}
+
+	status = request(CTL_PAUSE).Status
+	if status == nil || !status.Paused {
+		t.Error("Expected to be paused:", status)
+	}
+	if request(CTL_SYNC).Error == "" {
+		t.Error("Sync while paused should be refused")
+	}
+
+	activity := request(CTL_ACTIVITY).Activity
+	if len(activity) != 2 || activity[1].Message != "Paused" {
+		t.Error("Unexpected activity:", activity)
+	}
+
+	if request("explode").Error == "" {
+		t.Error("Expected error for unknown command")
+	}
+
+	_, err = NewControlServer(path, calls)
+	if err == nil {
+		t.Error("Second client shouldn't take over a live control socket")
+	}
+}
+
+func TestSyncCommitFails(t *testing.T) {
+
+	external := &MockExternal{fails: []string{"/usr/bin/git commit"}}
+	client := Client{
+		backend:  NewGitBackend(&Config{syncDir: "/tmp/fake"}, external),
+		external: external,
+		notifier: &MockNotifier{},
+		syncDir:  "/tmp/fake",
+	}
+
+	err := client.Sync(TRIGGER_CONTROL, nil)
+	if err == nil || len(client.lastError) == 0 || !client.lastSync.IsZero() {
+		t.Error("A failed commit should fail the sync:", err, client.lastError)
+	}
+	if len(client.activity) != 1 || !strings.HasPrefix(client.activity[0].Message, "Sync failed") {
+		t.Error("Unexpected activity:", client.activity)
+	}
+	if strings.Contains(strings.Join(external.cmds, "\n"), "push") {
+		t.Error("Shouldn't push after a failed commit:", external.cmds)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+
+	external := &MockExternal{}
+	client := Client{
+		backend:  NewGitBackend(&Config{syncDir: "/tmp/fake"}, external),
+		external: external,
+		notifier: &MockNotifier{},
+		syncDir:  "/tmp/fake",
+		hostName: "laptop",
+	}
+
+	client.pause(time.Hour)
+	if !client.paused || client.autoResume == nil {
+		t.Fatal("Expected to be paused, with a timeout")
+	}
+
+	client.pending = []Event{
+		{"/tmp/fake/.vimrc", "Edit"},
+		{"/tmp/fake/.vimrc", "Edit"},
+		{"/tmp/fake/bin/backup", "Create"},
+	}
+	client.Sync(TRIGGER_INCOMING, nil)
+	if len(external.cmds) != 0 {
+		t.Error("Sync should do nothing while paused:", external.cmds)
+	}
+
+	err := client.resume()
+	if err != nil || client.paused || client.autoResume != nil || len(client.pending) != 0 {
+		t.Error("Expected to be resumed, and synced:", err)
+	}
+
+	var commit string
+	for _, cmd := range external.cmds {
+		if strings.HasPrefix(cmd, "/usr/bin/git commit") {
+			commit = cmd
+		}
+	}
+	if !strings.Contains(commit, ", files changed: 2\n\n.vimrc\nbin/backup\n\n") ||
+		!strings.Contains(commit, "Loftus-Trigger: Resume\nLoftus-Events: 3") {
+		t.Error("Expected one commit of everything, each file once:", commit)
+	}
+}
+
+func TestDescribeUpdate(t *testing.T) {
+
+	msg := NewMessage(MSG_UPDATE, "repo1", "sender1", "")
+	msg.Host = "laptop"
+
+	var paths []string
+	for i := 0; i < MAX_MSG_PATHS+2; i++ {
+		paths = append(paths, "file"+strconv.Itoa(i))
+	}
+	msg.SetPaths(paths)
+
+	decoded, err := decodeMessage(msg.Encode())
+	if err != nil || len(decoded.Paths) != MAX_MSG_PATHS || decoded.More != 2 {
+		t.Fatal("Paths should be capped, and the rest counted:", decoded, err)
+	}
+	if decoded.Describe() != "laptop changed file0, 11 others" {
+		t.Error("Unexpected description:", decoded.Describe())
+	}
+
+	msg.SetPaths([]string{".vimrc"})
+	if msg.Describe() != "laptop changed .vimrc" {
+		t.Error("Unexpected description:", msg.Describe())
+	}
+}
+
+func TestPathsFitLanPacket(t *testing.T) {
+
+	msg := NewMessage(MSG_UPDATE, strings.Repeat("r", 40), "0123456789abcdef", strings.Repeat("h", 40))
+	msg.Host = "a-rather-long-host-name.example.com"
+	msg.Peer = ":51235"
+
+	var paths []string
+	for i := 0; i < MAX_MSG_PATHS; i++ {
+		paths = append(paths, ".config/some-application/profiles/default/"+
+			strings.Repeat("nested/", 10)+"settings-"+strconv.Itoa(i)+".json")
+	}
+	msg.SetPaths(paths)
+
+	// What the receiver's buffer holds, see LanNotifier.listen
+	buf := make([]byte, LAN_PACKET_SIZE)
+	n := copy(buf, msg.Encode())
+	decoded, err := decodeMessage(string(buf[:n]))
+	if err != nil {
+		t.Fatal("Update didn't fit in a LAN packet:", len(msg.Encode()), err)
+	}
+	if len(decoded.Paths) == 0 || len(decoded.Paths) == MAX_MSG_PATHS || len(decoded.Paths)+decoded.More != MAX_MSG_PATHS {
+		t.Error("Expected some paths listed and the rest counted:", len(decoded.Paths), decoded.More)
+	}
+
+	// A path longer than a packet is only counted
+	msg.SetPaths([]string{strings.Repeat("x", LAN_PACKET_SIZE)})
+	if len(msg.Encode()) > LAN_PACKET_SIZE || len(msg.Paths) != 0 || msg.More != 1 {
+		t.Error("Expected the path counted instead:", len(msg.Encode()), msg.More)
+	}
+}
+
+func TestLanGroups(t *testing.T) {
+
+	lan, err := NewLanNotifier("239.255.76.67:51234, [ff02::4c46]:51234", "", "sender1")
+	if err != nil || len(lan.groups) != 2 || lan.groups[1].IP.To4() != nil {
+		t.Error("Expected an IPv4 and an IPv6 group:", lan, err)
+	}
+
+	_, err = NewLanNotifier("192.168.1.1:51234", "", "sender1")
+	if err == nil {
+		t.Error("Expected error for a group which isn't multicast")
+	}
+}
+
+func TestMdnsMessages(t *testing.T) {
+
+	mdns := NewMdns("laptop", 8007, map[string]string{"role": ROLE_SERVER})
+	msg, err := parseDns(mdns.response(MDNS_TTL, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	services := msg.services()
+	if len(services) != 1 {
+		t.Fatal("Expected one service, got", services)
+	}
+	service := services[0]
+	if service.Name() != "laptop" || service.Port != 8007 || service.Txt["role"] != ROLE_SERVER {
+		t.Error("Unexpected service:", service)
+	}
+
+	// Other implementations compress names, pointing back to earlier ones
+	compressed := dnsHeader(0, DNS_FLAG_QR, 0, 1)
+	compressed = appendRecord(compressed, MDNS_SERVICE, DNS_TYPE_PTR, DNS_CLASS_IN, MDNS_TTL,
+		append([]byte{4, 'd', 'e', 's', 'k'}, 0xC0, 12))
+	msg, err = parseDns(compressed)
+	if err != nil || len(msg.services()) != 1 || msg.services()[0].Instance != "desk."+MDNS_SERVICE {
+		t.Error("Compressed name not followed:", msg, err)
+	}
+
+	_, err = parseDns(compressed[:20])
+	if err == nil {
+		t.Error("Expected error for truncated message")
+	}
+}
+
+func TestReconnectSync(t *testing.T) {
+
+	config := &Config{syncDir: "/tmp/fake"}
+	external := &MockExternal{}
+	client := Client{
+		backend:  NewGitBackend(config, external),
+		external: external,
+		isOnline: true,
+	}
+
+	client.connChanged(ConnState{State: CONN_CONNECTED})
+	if len(external.cmds) != 0 {
+		t.Error("First connection should not sync:", external.cmds)
+	}
+
+	client.connChanged(ConnState{State: CONN_RECONNECTING, LastError: "EOF"})
+	client.connChanged(ConnState{State: CONN_CONNECTED})
+
+	synced := false
+	for _, cmd := range external.cmds {
+		if strings.Contains(cmd, "Loftus-Trigger: "+TRIGGER_RECONNECT) {
+			synced = true
+		}
+	}
+	if !synced {
+		t.Error("Expected a catch-up sync after reconnecting:", external.cmds)
+	}
+}
+
+func TestHeartbeatCheck(t *testing.T) {
+
+	good := Heartbeat{Interval: DEFAULT_HEARTBEAT, Timeout: DEFAULT_HEARTBEAT_TIMEOUT}
+	if good.Check() != nil {
+		t.Error("Default heartbeat rejected:", good.Check())
+	}
+	for _, bad := range []Heartbeat{
+		{Interval: 0, Timeout: time.Minute},
+		{Interval: -time.Second, Timeout: time.Minute},
+		{Interval: time.Second, Timeout: 0},
+	} {
+		if bad.Check() == nil {
+			t.Error("Expected error for", bad)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+
+	for attempt := 0; attempt < 100; attempt++ {
+		wait := backoff(attempt)
+		if wait < BACKOFF_MIN/2 || wait > BACKOFF_MAX {
+			t.Error("Attempt", attempt, "wait out of range:", wait)
+		}
+	}
+	if backoff(0) > BACKOFF_MIN || backoff(4) < 8*BACKOFF_MIN {
+		t.Error("Backoff should double each attempt")
+	}
+}
+
+func TestParseCommitMsg(t *testing.T) {
+
+	meta := CommitMeta{Host: "laptop", User: "graham", Version: VERSION, Trigger: TRIGGER_WATCH, Events: 2}
+
+	summary, parsed := parseCommitMsg(meta.Format("Edit: .vimrc, .bashrc"))
+	if summary != "Edit: .vimrc, .bashrc" || parsed != meta {
+		t.Error("Unexpected parse: ", summary, parsed)
+	}
+
+	summary, parsed = parseCommitMsg("Fixed by hand\n")
+	if summary != "Fixed by hand" || parsed != (CommitMeta{}) {
+		t.Error("Unexpected parse of plain commit: ", summary, parsed)
+	}
+}
+
+func TestRetentionKeep(t *testing.T) {
+
+	policy, err := parseRetention("1d:*,7d:1h,*:1d")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2013, 5, 21, 12, 0, 0, 0, time.UTC)
+	at := func(ago time.Duration) Revision {
+		return Revision{When: now.Add(-ago)}
+	}
+
+	revisions := []Revision{
+		at(30 * 24 * time.Hour),            // First, always kept
+		at(20*24*time.Hour + 10*time.Hour), // Same day as next, dropped
+		at(20*24*time.Hour + 8*time.Hour),
+		at(3*24*time.Hour + 30*time.Minute), // Same hour as next, dropped
+		at(3*24*time.Hour + 20*time.Minute),
+		at(2 * time.Hour), // Within a day, all kept
+		at(time.Hour),
+	}
+
+	expected := []bool{true, false, true, false, true, true, true}
+	if fmt.Sprintf("%v", policy.Keep(revisions, now)) != fmt.Sprintf("%v", expected) {
+		t.Error("Unexpected keep: ", policy.Keep(revisions, now))
+	}
+
+	for _, spec := range []string{"7d:500ms", "7d:0s", "7d:-1h", "7d", "7d:often"} {
+		_, err = parseRetention(spec)
+		if err == nil {
+			t.Error("Expected error for retention", spec)
+		}
+	}
+}
+
+// Run git in dir, for tests which need a real repository
+func testGit(t *testing.T, dir string, when time.Time, args ...string) string {
+	t.Helper()
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	date := when.Format(time.RFC3339)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_DATE="+date, "GIT_COMMITTER_DATE="+date,
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatal("git", args, err, string(output))
+	}
+	return strings.TrimSpace(string(output))
+}
+
+func TestCompactKeepsMerges(t *testing.T) {
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("Needs git")
+	}
+
+	work := t.TempDir()
+	day := time.Now().UTC().Truncate(24 * time.Hour)
+	ago := func(age time.Duration) time.Time { return day.Add(-age) }
+	commit := func(when time.Time, msg string) {
+		testGit(t, work, when, "commit", "--allow-empty", "--quiet", "--message="+msg)
+	}
+
+	testGit(t, work, ago(0), "init", "--quiet", "--initial-branch=master")
+	commit(ago(40*24*time.Hour), "First")
+	commit(ago(20*24*time.Hour-time.Hour), "Same day as the next, dropped")
+	commit(ago(20*24*time.Hour-3*time.Hour), "Kept for it's day")
+
+	// Another host's change, merged where we keep everything
+	testGit(t, work, ago(0), "checkout", "--quiet", "-b", "other")
+	commit(ago(2*24*time.Hour), "Other host\n\nLoftus-Host: other")
+	testGit(t, work, ago(0), "checkout", "--quiet", "master")
+	commit(ago(2*24*time.Hour-time.Hour), "Ours")
+	testGit(t, work, ago(24*time.Hour), "merge", "--no-ff", "--quiet", "--message=Merge", "other")
+	commit(ago(-time.Hour), "Latest")
+
+	bare := filepath.Join(t.TempDir(), "repo.git")
+	testGit(t, work, ago(0), "clone", "--bare", "--quiet", work, bare)
+
+	policy, _ := parseRetention("7d:*,*:1d")
+	backend := NewGitBackend(&Config{syncDir: bare}, &RealExternal{})
+	removed, err := backend.Compact(policy)
+	if err != nil || removed != 1 {
+		t.Fatal("Expected one commit removed:", removed, err)
+	}
+
+	merges := testGit(t, bare, ago(0), "rev-list", "--merges", "--count", "HEAD")
+	messages := testGit(t, bare, ago(0), "log", "--format=%B", "HEAD")
+	if merges != "1" || !strings.Contains(messages, "Loftus-Host: other") {
+		t.Error("Merge and the other host's commit should survive:", merges, messages)
+	}
+	if !strings.Contains(messages, TRAILER_COMPACTED+": 1") || strings.Contains(messages, "dropped") {
+		t.Error("Expected the dropped commit squashed in to the next:", messages)
+	}
+}
+
+func TestPullAfterFailedRewrite(t *testing.T) {
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("Needs git")
+	}
+
+	now := time.Now()
+	work, client := t.TempDir(), t.TempDir()
+	bare := filepath.Join(t.TempDir(), "repo.git")
+	commit := func(dir string, content string) string {
+		os.WriteFile(filepath.Join(dir, "a.txt"), []byte(content), 0644)
+		testGit(t, dir, now, "commit", "--all", "--quiet", "--message="+content)
+		return testGit(t, dir, now, "rev-parse", "HEAD")
+	}
+
+	testGit(t, work, now, "init", "--quiet", "--initial-branch=master")
+	os.WriteFile(filepath.Join(work, "a.txt"), []byte("first"), 0644)
+	testGit(t, work, now, "add", "a.txt")
+	commit(work, "first")
+	second := commit(work, "second")
+	testGit(t, work, now, "clone", "--bare", "--quiet", work, bare)
+
+	testGit(t, client, now, "clone", "--quiet", bare, ".")
+	testGit(t, client, now, "config", "user.name", "test")
+	testGit(t, client, now, "config", "user.email", "test@example.com")
+	backend := NewGitBackend(&Config{syncDir: client}, &RealExternal{})
+	err := backend.Pull()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit(client, "ours")
+
+	// Compaction rewrote the remote, in a way our commit conflicts with
+	testGit(t, work, now, "reset", "--quiet", "--hard", "HEAD~1")
+	commit(work, "rewritten")
+	testGit(t, work, now, "push", "--quiet", "--force", bare, "master")
+
+	if backend.Pull() == nil {
+		t.Fatal("Expected the rebase on to the new history to fail")
+	}
+
+	// Still rewritten as far as we're concerned, so no merge of the old history
+	backend.Pull()
+	merged := exec.Command("git", "merge-base", "--is-ancestor", "origin/master", "HEAD")
+	merged.Dir = client
+	_, mergeErr := os.Stat(filepath.Join(client, ".git", "MERGE_HEAD"))
+	if merged.Run() == nil || mergeErr == nil {
+		t.Error("Old history was merged with the rewritten one")
+	}
+	if last := testGit(t, client, now, "rev-parse", LAST_REMOTE_REF); last != second {
+		t.Error("Expected the last remote head we integrated, got", last)
+	}
+}
+
+func TestOverrideScore(t *testing.T) {
+
+	backend := &GitBackend{hostName: "laptop", userName: "graham"}
+
+	specs := map[string]int{
+		"default":                        0,
+		"host=laptop":                    4,
+		"user=graham":                    2,
+		"os=" + runtime.GOOS:             1,
+		"host=laptop,user=graham":        6,
+		"user=graham,os=" + runtime.GOOS: 3,
+		"host=desktop":                   -1,
+		"host=laptop,user=other":         -1,
+		"colour=blue":                    -1,
+		"laptop":                         -1,
+	}
+	for conditions, expected := range specs {
+		score := backend.overrideScore(conditions)
+		if score != expected {
+			t.Error("Score of", conditions, "is", score, "expected", expected)
+		}
+	}
+}
+
+func TestBestVariant(t *testing.T) {
+
+	backend := &GitBackend{hostName: "laptop", userName: "graham"}
+	goos := "os=" + runtime.GOOS
+
+	specs := []struct {
+		candidates []string
+		expected   string
+	}{
+		{[]string{"a##default"}, "a##default"},
+		{[]string{"a##default", "a##host=laptop"}, "a##host=laptop"},
+		{[]string{"a##host=desktop"}, ""},
+		{[]string{"a##user=graham", "a##host=laptop"}, "a##host=laptop"},
+		{[]string{"a##" + goos, "a##user=graham"}, "a##user=graham"},
+		{[]string{"a##host=desktop", "a##default"}, "a##default"},
+		// Same score: the first by name wins, whatever the order found
+		{[]string{"a##user=graham," + goos, "a##" + goos + ",user=graham"}, "a##" + goos + ",user=graham"},
+		{[]string{"a##" + goos + ",user=graham", "a##user=graham," + goos}, "a##" + goos + ",user=graham"},
+		// Only the file's name has conditions
+		{[]string{"dir##host=desktop/a##user=graham"}, "dir##host=desktop/a##user=graham"},
+		{[]string{"dir##user=graham/a##host=desktop"}, ""},
+	}
+	for _, spec := range specs {
+		best := backend.bestVariant(spec.candidates)
+		if best != spec.expected {
+			t.Error("Best of", spec.candidates, "is", best, "expected", spec.expected)
+		}
+	}
+}
+
+func TestFindGenerated(t *testing.T) {
+
+	dir := t.TempDir()
+	for _, name := range []string{
+		".xprofile##host=laptop", ".xprofile##default", "conf/app##user=graham",
+		".gitconfig##template", "plain", ".git/refs##default", "a##b/.xinitrc##host=laptop"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		os.WriteFile(filepath.Join(dir, name), []byte("x"), 0644)
+	}
+
+	backend := &GitBackend{rootDir: dir}
+	variants, templates, err := backend.findGenerated()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]string{
+		".xprofile":     {".xprofile##default", ".xprofile##host=laptop"},
+		"conf/app":      {"conf/app##user=graham"},
+		"a##b/.xinitrc": {"a##b/.xinitrc##host=laptop"},
+	}
+	if !reflect.DeepEqual(variants, expected) {
+		t.Error("Unexpected variants:", variants)
+	}
+	if !reflect.DeepEqual(templates, []string{".gitconfig##template"}) {
+		t.Error("Unexpected templates:", templates)
+	}
+
+	// The link goes inside the '##' directory, which is left alone
+	backend.hostName = "laptop"
+	backend.applyOverrides(map[string][]string{"a##b/.xinitrc": variants["a##b/.xinitrc"]})
+	target, err := os.Readlink(filepath.Join(dir, "a##b", ".xinitrc"))
+	info, _ := os.Lstat(filepath.Join(dir, "a##b"))
+	if err != nil || target != ".xinitrc##host=laptop" || !info.IsDir() {
+		t.Error("Expected a link in the directory:", target, err)
+	}
+}
+
+func TestLinkVariant(t *testing.T) {
+
+	dir := t.TempDir()
+	backend := &GitBackend{rootDir: dir}
+	os.Mkdir(filepath.Join(dir, "conf"), 0755)
+	os.WriteFile(filepath.Join(dir, "conf/app##default"), []byte("default"), 0644)
+	os.WriteFile(filepath.Join(dir, "conf/app##host=laptop"), []byte("laptop"), 0644)
+
+	read := func(name string) string {
+		content, _ := os.ReadFile(filepath.Join(dir, name))
+		return string(content)
+	}
+
+	// Link, relative to the canonical's directory
+	err := backend.linkVariant("conf/app", "conf/app##default")
+	target, _ := os.Readlink(filepath.Join(dir, "conf/app"))
+	if err != nil || target != "app##default" || read("conf/app") != "default" {
+		t.Error("Expected a link to the default:", target, err)
+	}
+
+	// Relink
+	err = backend.linkVariant("conf/app", "conf/app##host=laptop")
+	if err != nil || read("conf/app") != "laptop" {
+		t.Error("Expected a link to the laptop variant:", read("conf/app"), err)
+	}
+
+	// Nothing matches any more
+	err = backend.linkVariant("conf/app", "")
+	_, statErr := os.Lstat(filepath.Join(dir, "conf/app"))
+	if err != nil || !os.IsNotExist(statErr) {
+		t.Error("Expected our link removed:", statErr, err)
+	}
+
+	// A real file is never replaced
+	os.WriteFile(filepath.Join(dir, "conf/app"), []byte("mine"), 0644)
+	err = backend.linkVariant("conf/app", "conf/app##default")
+	if err != nil || read("conf/app") != "mine" {
+		t.Error("Expected the real file left alone:", read("conf/app"), err)
+	}
+	err = backend.linkVariant("conf/app", "")
+	if err != nil || read("conf/app") != "mine" {
+		t.Error("Expected the real file kept:", read("conf/app"), err)
+	}
+}
+
+func TestExcludeCanonicals(t *testing.T) {
+
+	dir := t.TempDir()
+	backend := &GitBackend{rootDir: dir}
+	excludeFile := filepath.Join(dir, ".git", "info", "exclude")
+
+	read := func() string {
+		content, _ := os.ReadFile(excludeFile)
+		return string(content)
+	}
+
+	// No exclude file yet
+	err := backend.excludeCanonicals([]string{"b", "a"})
+	expected := EXCLUDE_START + "\n/a\n/b\n" + EXCLUDE_END + "\n"
+	if err != nil || read() != expected {
+		t.Error("Unexpected exclude file:", read(), err)
+	}
+
+	// The user's own lines are kept, and our block replaced
+	os.WriteFile(excludeFile, []byte("*.swp\n"+expected+"*.bak\n"), 0644)
+	err = backend.excludeCanonicals([]string{"conf/app"})
+	expected = "*.swp\n*.bak\n" + EXCLUDE_START + "\n/conf/app\n" + EXCLUDE_END + "\n"
+	if err != nil || read() != expected {
+		t.Error("Unexpected exclude file:", read(), err)
+	}
+
+	// Nothing to exclude removes our block
+	err = backend.excludeCanonicals(nil)
+	if err != nil || read() != "*.swp\n*.bak\n" {
+		t.Error("Expected our block removed:", read(), err)
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+
+	deployer := &Deployer{syncDir: "/sync", home: "/home/graham"}
+
+	entries, err := deployer.parseManifest(
+		"# repo path  target\n\nbashrc .bashrc\nconfig/i3 ~/.config/i3\nssh/config /home/graham/.ssh/config copy\n")
+	expected := []DeployEntry{
+		{Source: "/sync/bashrc", Target: "/home/graham/.bashrc"},
+		{Source: "/sync/config/i3", Target: "/home/graham/.config/i3"},
+		{Source: "/sync/ssh/config", Target: "/home/graham/.ssh/config", IsCopy: true},
+	}
+	if err != nil || !reflect.DeepEqual(entries, expected) {
+		t.Error("Unexpected entries:", entries, err)
+	}
+
+	bad := []string{
+		"bashrc",
+		"bashrc .bashrc link",
+		"../../etc/passwd .bashrc",
+		". .bashrc",
+		".git/config .gitconfig",
+		"bashrc /etc/bash.bashrc",
+		"bashrc ../other/.bashrc",
+		"bashrc ~/../other/.bashrc",
+		"bashrc ~/",
+	}
+	for _, line := range bad {
+		_, err := deployer.parseManifest(line)
+		if err == nil {
+			t.Error("Expected an error for:", line)
+		}
+	}
+
+	// Without $HOME nothing is inside it
+	_, err = (&Deployer{syncDir: "/sync"}).parseManifest("bashrc /.bashrc")
+	if err == nil {
+		t.Error("Expected an error when $HOME isn't set")
+	}
+}
+
+// A sync directory and a home directory, for deploying from one to the other
+func deployDirs(t *testing.T) (*Deployer, func(name string) string) {
+
+	root := t.TempDir()
+	deployer := &Deployer{syncDir: filepath.Join(root, "sync"), home: filepath.Join(root, "home")}
+	os.Mkdir(deployer.syncDir, 0755)
+	os.Mkdir(deployer.home, 0755)
+
+	read := func(path string) string {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err.Error()
+		}
+		return string(content)
+	}
+	return deployer, read
+}
+
+func TestDeployLink(t *testing.T) {
+
+	deployer, read := deployDirs(t)
+	entry := func(name string) DeployEntry {
+		return DeployEntry{
+			Source: filepath.Join(deployer.syncDir, name),
+			Target: filepath.Join(deployer.home, "."+name)}
+	}
+	isLinked := func(entry DeployEntry) bool {
+		current, _ := os.Readlink(entry.Target)
+		return current == entry.Source
+	}
+
+	// New target, in a directory which doesn't exist yet
+	fresh := DeployEntry{
+		Source: filepath.Join(deployer.syncDir, "i3"),
+		Target: filepath.Join(deployer.home, ".config", "i3")}
+	os.WriteFile(fresh.Source, []byte("i3"), 0644)
+	adopted, err := deployer.deployLink(fresh, false)
+	if err != nil || adopted || !isLinked(fresh) {
+		t.Error("Expected a new link:", adopted, err)
+	}
+
+	// Already linked
+	adopted, err = deployer.deployLink(fresh, true)
+	if err != nil || adopted || !isLinked(fresh) {
+		t.Error("Expected the link left alone:", adopted, err)
+	}
+
+	// Not in the repo yet: adopt
+	adopt := entry("vimrc")
+	os.WriteFile(adopt.Target, []byte("vim"), 0644)
+	adopted, err = deployer.deployLink(adopt, false)
+	if err != nil || !adopted || !isLinked(adopt) || read(adopt.Source) != "vim" {
+		t.Error("Expected vimrc adopted:", adopted, err)
+	}
+
+	// Same content: replace with a link
+	same := entry("bashrc")
+	os.WriteFile(same.Source, []byte("bash"), 0644)
+	os.WriteFile(same.Target, []byte("bash"), 0644)
+	adopted, err = deployer.deployLink(same, false)
+	if err != nil || adopted || !isLinked(same) {
+		t.Error("Expected bashrc linked:", adopted, err)
+	}
+
+	// A program replaced our link with a real file: adopt it's changes
+	os.Remove(same.Target)
+	os.WriteFile(same.Target, []byte("bash edited"), 0644)
+	adopted, err = deployer.deployLink(same, true)
+	if err != nil || !adopted || !isLinked(same) || read(same.Source) != "bash edited" {
+		t.Error("Expected the edit adopted:", adopted, read(same.Source), err)
+	}
+
+	// Someone else's file: back it up
+	other := entry("profile")
+	os.WriteFile(other.Source, []byte("ours"), 0644)
+	os.WriteFile(other.Target, []byte("theirs"), 0644)
+	adopted, err = deployer.deployLink(other, false)
+	if err != nil || adopted || !isLinked(other) || read(other.Target+BACKUP_SUFFIX) != "theirs" {
+		t.Error("Expected profile backed up:", adopted, err)
+	}
+
+	// Someone else's symlink is left alone, unless we made it
+	elsewhere := filepath.Join(deployer.home, "elsewhere")
+	os.Remove(other.Target)
+	os.Symlink(elsewhere, other.Target)
+	_, err = deployer.deployLink(other, false)
+	if current, _ := os.Readlink(other.Target); err != nil || current != elsewhere {
+		t.Error("Expected their symlink left alone:", current, err)
+	}
+	_, err = deployer.deployLink(other, true)
+	if err != nil || !isLinked(other) {
+		t.Error("Expected our symlink repaired:", err)
+	}
+}
+
+func TestDeployCopy(t *testing.T) {
+
+	deployer, read := deployDirs(t)
+	entry := DeployEntry{
+		Source: filepath.Join(deployer.syncDir, "ssh-config"),
+		Target: filepath.Join(deployer.home, ".ssh", "config"),
+		IsCopy: true}
+	age := func(path string, ago time.Duration) {
+		when := time.Now().Add(-ago)
+		os.Chtimes(path, when, when)
+	}
+
+	// Only in the repo: copy out
+	os.WriteFile(entry.Source, []byte("repo"), 0600)
+	adopted, err := deployer.deployCopy(entry)
+	if err != nil || adopted || read(entry.Target) != "repo" {
+		t.Error("Expected a copy out:", adopted, read(entry.Target), err)
+	}
+	if info, _ := os.Lstat(entry.Target); info.Mode() != 0600 {
+		t.Error("Expected the permissions copied:", info.Mode())
+	}
+
+	// Target changed last: copy in
+	os.WriteFile(entry.Target, []byte("target"), 0600)
+	age(entry.Source, time.Hour)
+	adopted, err = deployer.deployCopy(entry)
+	if err != nil || !adopted || read(entry.Source) != "target" {
+		t.Error("Expected a copy in:", adopted, read(entry.Source), err)
+	}
+
+	// Repo changed last: copy out
+	os.WriteFile(entry.Source, []byte("pulled"), 0600)
+	age(entry.Target, time.Hour)
+	adopted, err = deployer.deployCopy(entry)
+	if err != nil || adopted || read(entry.Target) != "pulled" {
+		t.Error("Expected a copy out:", adopted, read(entry.Target), err)
+	}
+
+	// Only the target: adopt, leaving the target where it is
+	os.Remove(entry.Source)
+	adopted, err = deployer.deployCopy(entry)
+	if err != nil || !adopted || read(entry.Source) != "pulled" || read(entry.Target) != "pulled" {
+		t.Error("Expected the target adopted:", adopted, err)
+	}
+}
+
+func TestDeploy(t *testing.T) {
+
+	deployer, read := deployDirs(t)
+	os.MkdirAll(filepath.Join(deployer.syncDir, ".loftus"), 0755)
+	os.WriteFile(filepath.Join(deployer.syncDir, DEPLOY_MANIFEST), []byte("bashrc .bashrc\nmissing .missing\n"), 0644)
+	os.WriteFile(filepath.Join(deployer.syncDir, "bashrc"), []byte("bash"), 0644)
+
+	adopted, err := deployer.Deploy()
+	if err != nil || len(adopted) != 0 || read(filepath.Join(deployer.home, ".bashrc")) != "bash" {
+		t.Error("Expected bashrc deployed:", adopted, err)
+	}
+
+	// Only what we deployed is remembered
+	state := read(filepath.Join(deployer.syncDir, ".git", DEPLOY_STATE))
+	if state != filepath.Join(deployer.home, ".bashrc") {
+		t.Error("Unexpected deploy state:", state)
+	}
+
+	os.WriteFile(filepath.Join(deployer.syncDir, DEPLOY_MANIFEST), []byte("bashrc /etc/bash.bashrc\n"), 0644)
+	_, err = deployer.Deploy()
+	if err == nil {
+		t.Error("Expected a target outside $HOME refused")
+	}
+}
+
+func TestClientArgs(t *testing.T) {
+
+	hostName, _ := os.Hostname()
+	config := &Config{syncDir: "/home/graham/loftus", hostName: hostName, secretFile: defaultSecretFile()}
+	if args := clientArgs(config); args != "--dir=/home/graham/loftus" {
+		t.Error("Expected only --dir by default, got:", args)
+	}
+
+	config = &Config{
+		syncDir:    "/home/graham/my files",
+		serverAddr: "an.example.com:8007",
+		hostName:   "laptop-" + hostName,
+		secretFile: "/etc/loftus/secret",
+		isTls:      true,
+		tlsCa:      "/etc/loftus/ca.pem"}
+	expected := `"--dir=/home/graham/my files" --address=an.example.com:8007 --host=laptop-` + hostName +
+		" --secret-file=/etc/loftus/secret --tls --tls-ca=/etc/loftus/ca.pem"
+	if args := clientArgs(config); args != expected {
+		t.Error("Unexpected args:", args)
+	}
+}
+
+func TestUnrender(t *testing.T) {
+
+	backend := &GitBackend{hostName: "laptop", vars: TemplateVars{"email": "g@example.com"}}
+	tmpl := "[user]\n\temail = {{ .Var.email }}\n\tname = Graham\n# {{ .Host }}\n"
+
+	// Edit a plain line and add one: unambiguous
+	newTmpl, err := backend.unrender(tmpl, "[user]\n\temail = g@example.com\n\tname = Graham King\n# laptop\n[core]\n")
+	expected := "[user]\n\temail = {{ .Var.email }}\n\tname = Graham King\n# {{ .Host }}\n[core]\n"
+	if err != nil || newTmpl != expected {
+		t.Error("Unexpected template: ", newTmpl, err)
+	}
+
+	// Edit a line with a marker: conflict
+	_, err = backend.unrender(tmpl, "[user]\n\temail = other@example.com\n\tname = Graham\n# laptop\n")
+	if err == nil {
+		t.Error("Expected conflict editing a templated line")
+	}
+}
+
+func TestMessageProtocol(t *testing.T) {
+
+	sent := NewMessage(MSG_UPDATE, "repo1", "sender1", "abc123")
+	received, err := decodeMessage(sent.Encode())
+	if err != nil || received.Encode() != sent.Encode() {
+		t.Error("Unexpected decode: ", received, err)
+	}
+
+	_, err = decodeMessage(`{"v":99,"type":"update"}`)
+	if err == nil {
+		t.Error("Expected error for unknown protocol version")
+	}
+
+	_, err = decodeMessage("Updated\n")
+	if err == nil {
+		t.Error("Expected error for old text protocol")
+	}
+}
+
+func TestAuthHandshake(t *testing.T) {
+
+	handshake := func(serverSecret string, clientSecret string) (error, error) {
+		serverConn, clientConn := net.Pipe()
+		defer serverConn.Close()
+		defer clientConn.Close()
+
+		serverErr := make(chan error)
+		go func() {
+			err := serverHandshake(serverConn, bufio.NewReader(serverConn), serverSecret)
+			if err != nil {
+				serverConn.Close() // Like Server.handle
+			}
+			serverErr <- err
+		}()
+		clientErr := clientHandshake(clientConn, bufio.NewReader(clientConn), clientSecret, "sender1")
+		return <-serverErr, clientErr
+	}
+
+	serverErr, clientErr := handshake("s3cret", "s3cret")
+	if serverErr != nil || clientErr != nil {
+		t.Error("Matching secrets rejected:", serverErr, clientErr)
+	}
+
+	serverErr, clientErr = handshake("s3cret", "wrong")
+	if serverErr == nil || clientErr == nil {
+		t.Error("Wrong secret accepted:", serverErr, clientErr)
+	}
+
+	serverErr, clientErr = handshake("", "")
+	if serverErr != nil || clientErr != nil {
+		t.Error("No secret on server should accept everyone:", serverErr, clientErr)
+	}
+
+	// A server which doesn't know our secret could be anyone
+	serverErr, clientErr = handshake("", "s3cret")
+	if clientErr == nil {
+		t.Error("Server without the secret accepted:", serverErr)
+	}
+}
+
+func TestAuthMutual(t *testing.T) {
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	// An impostor replays the client's own proof, and a welcome for the wrong nonce
+	go func() {
+		bufRead := bufio.NewReader(serverConn)
+		challenge := NewMessage(MSG_CHALLENGE, "", "", "")
+		challenge.Nonce = "abcd"
+		serverConn.Write([]byte(challenge.Encode()))
+
+		line, _ := bufRead.ReadString('\n')
+		answer, _ := decodeMessage(line)
+		welcome := NewMessage(MSG_WELCOME, "", "", "")
+		welcome.Mac = answer.Mac
+		serverConn.Write([]byte(welcome.Encode()))
+	}()
+
+	err := clientHandshake(clientConn, bufio.NewReader(clientConn), "s3cret", "sender1")
+	if err == nil {
+		t.Error("Expected the impostor rejected")
+	}
+
+	// Proofs for the same nonce differ by who makes them
+	if authMac("s3cret", AUTH_CLIENT, "abcd") == authMac("s3cret", AUTH_SERVER, "abcd") {
+		t.Error("Client and server proofs must differ")
+	}
+}
+
+func TestCheckPin(t *testing.T) {
+
+	knownFile := filepath.Join(t.TempDir(), KNOWN_SERVERS)
+
+	if checkPin(knownFile, "one:8007", "aaaa") != nil {
+		t.Error("First certificate should be pinned")
+	}
+	if checkPin(knownFile, "one:8007", "aaaa") != nil {
+		t.Error("Pinned certificate rejected")
+	}
+	if checkPin(knownFile, "one:8007", "bbbb") == nil {
+		t.Error("Changed certificate accepted")
+	}
+	if checkPin(knownFile, "two:8007", "bbbb") != nil {
+		t.Error("Pins should be per server")
+	}
+}
+
+func TestClientTlsConfig(t *testing.T) {
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	config := &Config{isTls: true}
+
+	_, err := clientTlsConfig(config, "")
+	if err == nil {
+		t.Error("Expected an error without a server address")
+	}
+
+	// Found with mDNS: the pin is for the address we found
+	tlsConf, err := clientTlsConfig(config, "192.168.1.5:8007")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := []byte("not really a certificate")
+	err = tlsConf.VerifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Raw: cert}}})
+	known, _ := os.ReadFile(filepath.Join(home, TLS_DIR, KNOWN_SERVERS))
+	if err != nil || string(known) != "192.168.1.5:8007 "+fingerprint(cert)+"\n" {
+		t.Error("Expected the certificate pinned for it's address:", string(known), err)
+	}
+}
+
+func TestDiscovered(t *testing.T) {
+
+	server := Service{
+		Instance: "nas-server." + MDNS_SERVICE,
+		Port:     8007,
+		Addrs:    []net.IP{net.ParseIP("192.168.1.5")},
+		Txt:      map[string]string{"role": ROLE_SERVER},
+		Expires:  time.Now().Add(time.Minute)}
+	withTls := server
+	withTls.Txt = map[string]string{"role": ROLE_SERVER, "tls": "1"}
+
+	specs := []struct {
+		service     Service
+		trustsFound bool
+		isTls       bool
+		expected    string // addr and TLS we connected with, empty if we didn't
+	}{
+		{server, false, false, ""},
+		{withTls, false, false, ""},
+		{server, true, false, "192.168.1.5:8007 false"},
+		{withTls, true, false, "192.168.1.5:8007 true"},
+		{server, true, true, ""},
+		{withTls, true, true, "192.168.1.5:8007 true"},
+	}
+
+	for num, spec := range specs {
+		connected := ""
+		client := Client{
+			external:    &MockExternal{},
+			notifier:    &MockNotifier{},
+			trustsFound: spec.trustsFound,
+			isTls:       spec.isTls,
+			newServerNotifier: func(addr string, isTls bool) (Notifier, error) {
+				connected = addr + " " + strconv.FormatBool(isTls)
+				return &MockNotifier{}, nil
+			}}
+
+		client.discovered(spec.service)
+		if connected != spec.expected || client.serverAddr != strings.Split(spec.expected, " ")[0] {
+			t.Error("Spec", num, "connected to", connected, "expected", spec.expected)
+		}
+	}
+}
+
+func TestPeerUrl(t *testing.T) {
+
+	if extArg("/home/my user/100%") != "/home/my% user/100%%" {
+		t.Error("ext:: argument not escaped:", extArg("/home/my user/100%"))
+	}
+
+	args := peerPipeArgs(&Config{secretFile: "/tmp/secret", isTls: true, tlsCa: "/tmp/my ca.pem"})
+	url, _ := peerUrl(args, "192.168.1.2:51235")
+	if !strings.HasPrefix(url, "ext::") ||
+		!strings.HasSuffix(url, " --secret-file=/tmp/secret --tls --tls-ca=/tmp/my% ca.pem peer-pipe 192.168.1.2:51235 %S") {
+		t.Error("Wrong peer url:", url)
+	}
+
+	_, err := NewPeerServer(t.TempDir(), 0, "", nil)
+	if err == nil {
+		t.Error("Peer server should need a secret")
+	}
+}
+
+func TestPeerServerTls(t *testing.T) {
+
+	t.Setenv("HOME", t.TempDir())
+	config := &Config{isTls: true}
+	serverTls, err := serverTlsConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := NewPeerServer(t.TempDir(), 0, "s3cret", serverTls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(peer.Port()))
+
+	clientTls, err := clientTlsConfig(config, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, _, err := getRemoteConnection(addr, clientTls, "s3cret", "peer-pipe")
+	if err != nil {
+		t.Fatal("Expected a TLS connection to the peer:", err)
+	}
+	conn.Close()
+
+	// Nothing in the clear. Speak first, or both sides wait for the other.
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(NewMessage(MSG_TEST, "", "", "").Encode()))
+	err = clientHandshake(conn, bufio.NewReader(conn), "s3cret", "peer-pipe")
+	if err == nil {
+		t.Error("Peer with --tls accepted a plain connection")
+	}
+}
+
+func TestPullPeer(t *testing.T) {
+
+	isAncestor := "/usr/bin/git merge-base --is-ancestor "
+	specs := []struct {
+		name     string
+		fails    []string
+		peerRoot string
+		expected string // Last git command, and the start of it's error
+	}{
+		{"nothing new", nil, "root1", isAncestor + PEER_REF + " HEAD <nil>"},
+		{"fast-forward", []string{isAncestor + PEER_REF}, "root1",
+			"/usr/bin/git merge --ff-only " + PEER_REF + " <nil>"},
+		{"merge", []string{isAncestor}, "root1",
+			"/usr/bin/git merge --no-edit " + PEER_REF + " <nil>"},
+		{"conflict", []string{isAncestor, "/usr/bin/git merge --no-edit"}, "root1",
+			"/usr/bin/git merge --abort git error running: /usr/bin/git merge --no-edit " + PEER_REF},
+		{"other repository", []string{isAncestor}, "root2",
+			"/usr/bin/git rev-list --max-parents=0 " + PEER_REF + " peer's master isn't from our repository, not merging it"},
+	}
+
+	for _, spec := range specs {
+		external := &MockExternal{fails: spec.fails, outputs: map[string]string{
+			"/usr/bin/git rev-list --max-parents=0 HEAD":        "root1\n",
+			"/usr/bin/git rev-list --max-parents=0 " + PEER_REF: spec.peerRoot + "\n",
+		}}
+		backend := NewGitBackend(&Config{syncDir: t.TempDir()}, external)
+
+		err := backend.PullPeer("192.168.1.2:51235")
+		last := external.cmds[len(external.cmds)-1] + " " + fmt.Sprint(err)
+		if !strings.HasPrefix(last, spec.expected) {
+			t.Error(spec.name, "unexpected:", last)
+		}
+	}
+}
+
+func TestServerBroadcast(t *testing.T) {
+
+	server := NewServer("", "", "s3cret", nil)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.serve(listener)
+	defer listener.Close()
+
+	// The last one is in a different repository
+	var conns []net.Conn
+	var readers []*bufio.Reader
+	for _, repo := range []string{"repo1", "repo1", "repo1", "repo2"} {
+		conn, bufRead, err := getRemoteConnection(listener.Addr().String(), nil, "s3cret", "sender")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		tcpSend(conn, NewMessage(MSG_SUBSCRIBE, repo, "", "").Encode())
+		conns = append(conns, conn)
+		readers = append(readers, bufRead)
+	}
+	waitForPeers(t, server.hub, 4)
+	time.Sleep(50 * time.Millisecond) // For the subscriptions
+
+	// Two messages in one write, so the server must keep what it buffered
+	first := NewMessage(MSG_UPDATE, "repo1", "sender0", "abc").Encode()
+	second := NewMessage(MSG_UPDATE, "repo1", "sender0", "def").Encode()
+	tcpSend(conns[0], first+second)
+
+	for i := 1; i < 3; i++ {
+		for _, expected := range []string{first, second} {
+			conns[i].SetReadDeadline(time.Now().Add(5 * time.Second))
+			line, err := readers[i].ReadString('\n')
+			if line != expected {
+				t.Error("Client", i, "expected", expected, "got", line, err)
+			}
+		}
+	}
+
+	for _, i := range []int{0, 3} {
+		conns[i].SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		line, err := readers[i].ReadString('\n')
+		if err == nil {
+			t.Error("Client", i, "should not get the message:", line)
+		}
+	}
+
+	conns[2].Close()
+	waitForPeers(t, server.hub, 3)
+}
+
+func TestHubDropsSlowPeer(t *testing.T) {
+
+	hub := NewHub()
+
+	slowServer, slowClient := net.Pipe() // Nobody reads slowClient
+	defer slowClient.Close()
+	slow := hub.Join(slowServer)
+	hub.Subscribe(slow, "repo1")
+
+	fastServer, fastClient := net.Pipe()
+	defer fastClient.Close()
+	hub.Subscribe(hub.Join(fastServer), "repo1")
+
+	waitForPeers(t, hub, 2)
+
+	// One at a time, so only the slow peer's queue fills
+	bufRead := bufio.NewReader(fastClient)
+	for i := 0; i < SEND_QUEUE+2; i++ {
+		sent := NewMessage(MSG_UPDATE, "", "", strconv.Itoa(i)).Encode()
+		hub.Broadcast(sent, "repo1", nil)
+		line, err := bufRead.ReadString('\n')
+		if line != sent {
+			t.Fatal("Fast peer expected", sent, "got", line, err)
+		}
+	}
+
+	waitForPeers(t, hub, 1)
+	hub.Leave(slow) // Already gone, must be harmless
+}
+
+func TestHeartbeat(t *testing.T) {
+
+	server := NewServer("", "", "", nil)
+	server.timeout = 300 * time.Millisecond
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.serve(listener)
+	defer listener.Close()
+
+	conn, bufRead, err := getRemoteConnection(listener.Addr().String(), nil, "", "sender")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Pings keep us connected past the timeout, and get answered
+	stop := make(chan bool)
+	go Heartbeat{Interval: 50 * time.Millisecond}.ping(conn, stop)
+	time.Sleep(500 * time.Millisecond)
+	close(stop)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufRead.ReadString('\n')
+	msg, _ := decodeMessage(line)
+	if msg == nil || msg.Type != MSG_PONG {
+		t.Fatal("Expected pong, got", line, err)
+	}
+	waitForPeers(t, server.hub, 1)
+
+	// Silence gets us dropped
+	waitForPeers(t, server.hub, 0)
+}
+
+// Wait until the hub has 'expected' peers, fail if it takes too long
+func waitForPeers(t *testing.T, hub *Hub, expected int) {
+	for i := 0; i < 100; i++ {
+		if hub.Count() == expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Expected", expected, "peers, have", hub.Count())
+}
+
+type MockNotifier struct {
+	announced []*Message
+}
+
+func (self *MockNotifier) Announce(msg *Message) error {
+	self.announced = append(self.announced, msg)
+	return nil
+}
+
+func (self *MockNotifier) Subscribe(channel chan *Message) error {
+	return nil
+}
+
+func (self *MockNotifier) Close() error {
+	return nil
+}
+
 type MockExternal struct {
-	cmds []string
+	cmds    []string
+	outputs map[string]string // Output of commands which start with the key. Longest key wins.
+	fails   []string          // Commands which start with any of these fail
 }
 
 func (self *MockExternal) Exec(rootDir string, cmd string, args ...string) ([]byte, error) {
 
-	self.cmds = append(self.cmds, cmd+" "+strings.Join(args, " "))
-	return []byte(""), nil
+	full := cmd + " " + strings.Join(args, " ")
+	self.cmds = append(self.cmds, full)
+
+	for _, prefix := range self.fails {
+		if strings.HasPrefix(full, prefix) {
+			return nil, errors.New("exit status 1")
+		}
+	}
+
+	var output, longest string
+	for prefix, out := range self.outputs {
+		if strings.HasPrefix(full, prefix) && len(prefix) > len(longest) {
+			output, longest = out, prefix
+		}
+	}
+	return []byte(output), nil
+}
+
+func TestExecOutput(t *testing.T) {
+
+	external := &RealExternal{}
+
+	output, err := external.Exec("", "sh", "-c", "echo out; echo warning >&2")
+	if err != nil || string(output) != "out\n" {
+		t.Error("Expected only stdout:", string(output), err)
+	}
+
+	_, err = external.Exec("", "sh", "-c", "echo broken >&2; exit 2")
+	if err == nil || errorOutput(err) != "broken\n" {
+		t.Error("Expected stderr in the error:", err, errorOutput(err))
+	}
+}
+
+// git log output, see GitBackend.log, for a commit which touched filename
+func logRecord(id string, when int, summary string, filename string) string {
+	return "\x1e" + id + "\x1f" + strconv.Itoa(when) + "\x1fGraham\x1f\x1f" + summary +
+		"\n\nLoftus-Host: laptop\n\x1f\n\n" + filename + "\n"
+}
+
+func TestHistoryFollow(t *testing.T) {
+
+	external := &MockExternal{outputs: map[string]string{
+		"/usr/bin/git log": logRecord("id2", 1369146600, "Rename", "new.txt") +
+			logRecord("id1", 1369143000, "Edit", "old.txt"),
+	}}
+	backend := NewGitBackend(&Config{syncDir: "/tmp/fake"}, external)
+
+	revisions, err := backend.History("new.txt")
+	if err != nil || len(revisions) != 2 {
+		t.Fatal("Expected two revisions:", revisions, err)
+	}
+	if !strings.HasSuffix(external.cmds[0], " --follow --name-only -- new.txt") {
+		t.Error("History should follow renames:", external.cmds[0])
+	}
+	first, second := revisions[0], revisions[1]
+	if first.Id != "id2" || first.Filename != "new.txt" || first.Meta.Host != "laptop" || first.Summary != "Rename" {
+		t.Error("Unexpected newest revision:", first)
+	}
+	if second.Id != "id1" || second.Filename != "old.txt" || second.When.Unix() != 1369143000 {
+		t.Error("Unexpected renamed revision:", second)
+	}
+
+	// id1 is the most recent change at or before abc, so it has the old name
+	external.cmds = nil
+	external.fails = []string{"/usr/bin/git merge-base --is-ancestor id2 "}
+	backend.Diff("new.txt", "abc")
+	last := external.cmds[len(external.cmds)-1]
+	if last != "/usr/bin/git diff abc:old.txt new.txt" {
+		t.Error("Diff should compare with the name at the revision:", last)
+	}
+
+	// Never renamed: a plain diff
+	external.outputs["/usr/bin/git log"] = logRecord("id1", 1369143000, "Edit", "new.txt")
+	external.cmds = nil
+	backend.Diff("new.txt", "abc")
+	last = external.cmds[len(external.cmds)-1]
+	if last != "/usr/bin/git diff abc -- new.txt" {
+		t.Error("Unexpected diff:", last)
+	}
+}
+
+func TestRestoreSymlink(t *testing.T) {
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("Needs git")
+	}
+
+	now := time.Now()
+	dir := t.TempDir()
+	link := filepath.Join(dir, ".xprofile")
+	testGit(t, dir, now, "init", "--quiet", "--initial-branch=master")
+	os.WriteFile(filepath.Join(dir, "script"), []byte("#!/bin/sh\n"), 0755)
+	os.Symlink("xprofile-laptop", link)
+	testGit(t, dir, now, "add", "--all")
+	testGit(t, dir, now, "commit", "--quiet", "--message=First")
+	first := testGit(t, dir, now, "rev-parse", "HEAD")
+
+	// A program replaced the link with a file, and the script was made private
+	os.Remove(link)
+	os.WriteFile(link, []byte("oops"), 0644)
+	os.Chmod(filepath.Join(dir, "script"), 0600)
+
+	err := restoreCmd(&Config{syncDir: dir, args: []string{".xprofile"}, commit: first})
+	target, linkErr := os.Readlink(link)
+	if err != nil || linkErr != nil || target != "xprofile-laptop" {
+		t.Error("Expected the symlink restored:", target, linkErr, err)
+	}
+
+	err = restoreCmd(&Config{syncDir: dir, args: []string{"script"}, commit: first})
+	info, _ := os.Stat(filepath.Join(dir, "script"))
+	if err != nil || info.Mode().Perm() != 0755 {
+		t.Error("Expected the script restored executable:", info.Mode(), err)
+	}
+
+	// Nothing older differs from the link as it is now
+	_, _, err = latestDifferent(NewGitBackend(&Config{syncDir: dir}, &RealExternal{}), dir, ".xprofile")
+	if err == nil {
+		t.Error("The restored link should match the stored one")
+	}
+
+	err = restoreCmd(&Config{syncDir: dir, args: []string{".xprofile"}, commit: first, at: "1h"})
+	if err == nil || !strings.HasPrefix(err.Error(), "Usage") {
+		t.Error("Expected usage error for --commit with --at:", err)
+	}
+}
+
+func TestLatestDifferent(t *testing.T) {
+
+	syncDir := t.TempDir()
+	os.WriteFile(filepath.Join(syncDir, "f.txt"), []byte("three"), 0644)
+
+	// id3 is what we have now, id2 deleted it, id1 is the one to restore
+	external := &MockExternal{
+		outputs: map[string]string{
+			"/usr/bin/git log": logRecord("id3", 1369146600, "Edit", "f.txt") +
+				logRecord("id2", 1369145000, "Delete", "f.txt") +
+				logRecord("id1", 1369143000, "Create", "old.txt"),
+			"/usr/bin/git ls-tree id3": "100644 blob aaa\tf.txt\n",
+			"/usr/bin/git show id3:":   "three",
+			"/usr/bin/git ls-tree id1": "100755 blob bbb\told.txt\n",
+			"/usr/bin/git show id1:":   "one",
+		},
+	}
+	backend := NewGitBackend(&Config{syncDir: syncDir}, external)
+
+	content, mode, err := latestDifferent(backend, syncDir, "f.txt")
+	if err != nil || string(content) != "one" || mode != 0755 {
+		t.Error("Expected the version before the delete:", string(content), mode, err)
+	}
+	if external.cmds[len(external.cmds)-1] != "/usr/bin/git show id1:old.txt" {
+		t.Error("Should read the old name:", external.cmds)
+	}
+
+	os.WriteFile(filepath.Join(syncDir, "f.txt"), []byte("one"), 0644)
+	external.outputs["/usr/bin/git show id3:"] = "one"
+	_, _, err = latestDifferent(backend, syncDir, "f.txt")
+	if err == nil {
+		t.Error("Expected error when every version is the same as now")
+	}
+}
+
+func TestResolveRevision(t *testing.T) {
+
+	external := &MockExternal{
+		outputs: map[string]string{
+			"/usr/bin/git rev-parse --verify --quiet abc^{commit}":   "abc1234567\n",
+			"/usr/bin/git rev-parse --verify --quiet 4412d^{commit}": "4412d00000\n",
+			"/usr/bin/git rev-list -1 --before=":                     "def7654321\n",
+		},
+		fails: []string{
+			"/usr/bin/git rev-parse --verify --quiet 2dd",
+			"/usr/bin/git rev-parse --verify --quiet 2d^",
+		},
+	}
+	backend := NewGitBackend(&Config{syncDir: "/tmp/fake"}, external)
+
+	rev, err := resolveRevision(backend, "abc")
+	if err != nil || rev != "abc1234567" {
+		t.Error("Expected the full commit id:", rev, err)
+	}
+
+	rev, err = resolveRevision(backend, "2d")
+	if err != nil || rev != "def7654321" {
+		t.Error("Expected the commit two days ago:", rev, err)
+	}
+
+	_, err = resolveRevision(backend, "2dd")
+	if err == nil || !strings.Contains(err.Error(), "neither a time") {
+		t.Error("Expected a helpful error for a mistyped time:", err)
+	}
+
+	// A short id which is also a number of days ago
+	external.cmds = nil
+	_, err = resolveRevision(backend, "4412d")
+	if err == nil || !strings.Contains(err.Error(), "both a commit id and a time") {
+		t.Error("Expected an error for an id which is also a time:", err)
+	}
+	if strings.Contains(strings.Join(external.cmds, "\n"), "rev-list -1 --before=") {
+		t.Error("Shouldn't guess the time was meant:", external.cmds)
+	}
+}
+
+func TestSnapshotLabel(t *testing.T) {
+
+	labels := map[string]string{
+		"Before i3 upgrade":  "before-i3-upgrade",
+		"  --Émacs / Vim!! ": "macs-vim",
+		"v2.0":               "v2-0",
+		"!!!":                "",
+	}
+	for name, expected := range labels {
+		if snapshotLabel(name) != expected {
+			t.Error("Label for", name, "should be", expected, "not", snapshotLabel(name))
+		}
+	}
+
+	refs := "HEAD -> master, tag: snapshot/before-upgrade, tag: v1, origin/master, tag: snapshot/clean"
+	if fmt.Sprint(snapshotLabels(refs)) != "[before-upgrade clean]" {
+		t.Error("Unexpected labels from refs:", snapshotLabels(refs))
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+
+	external := &MockExternal{outputs: map[string]string{
+		"/usr/bin/git for-each-ref": "before-i3-upgrade\x1fabc123\x1f1369146600\x1fBefore i3 upgrade\n" +
+			"clean\x1fdef456\x1f1369150000\x1fclean\n",
+	}}
+	backend := NewGitBackend(&Config{syncDir: "/tmp/fake"}, external)
+
+	err := backend.Snapshot("Before i3 upgrade")
+	if err != nil || external.cmds[0] != "/usr/bin/git tag --annotate snapshot/before-i3-upgrade --message=Before i3 upgrade" {
+		t.Error("Unexpected snapshot tag:", external.cmds, err)
+	}
+	if backend.Snapshot("!!!") == nil {
+		t.Error("Expected error for a name without letters or numbers")
+	}
+
+	snapshots, err := backend.Snapshots()
+	if err != nil || len(snapshots) != 2 {
+		t.Fatal("Expected two snapshots:", snapshots, err)
+	}
+	if !strings.HasSuffix(external.cmds[len(external.cmds)-1], " refs/tags/snapshot/") {
+		t.Error("Should only list snapshot tags:", external.cmds)
+	}
+	expected := Snapshot{Name: "Before i3 upgrade", Label: "before-i3-upgrade", Id: "abc123", When: time.Unix(1369146600, 0)}
+	if snapshots[0] != expected || snapshots[1].Label != "clean" {
+		t.Error("Unexpected snapshots:", snapshots)
+	}
+}
+
+func TestRollback(t *testing.T) {
+
+	external := &MockExternal{}
+	backend := NewGitBackend(&Config{syncDir: "/tmp/fake"}, external)
+
+	err := backend.Rollback("Before i3 upgrade")
+	expected := []string{
+		"/usr/bin/git rev-parse --verify --quiet snapshot/before-i3-upgrade",
+		"/usr/bin/git read-tree -u --reset snapshot/before-i3-upgrade",
+	}
+	if err != nil || fmt.Sprint(external.cmds) != fmt.Sprint(expected) {
+		t.Error("Unexpected rollback:", external.cmds, err)
+	}
+
+	// Unknown snapshots don't touch the tree
+	external.cmds = nil
+	external.fails = []string{"/usr/bin/git rev-parse"}
+	err = backend.Rollback("nope")
+	if err == nil || len(external.cmds) != 1 {
+		t.Error("Expected error, and no read-tree, for unknown snapshot:", external.cmds, err)
+	}
+}
+
+func TestParseWhen(t *testing.T) {
+
+	when, err := parseWhen("2013-05-21 14:30")
+	if err != nil || when.Format("2006-01-02 15:04") != "2013-05-21 14:30" {
+		t.Error("Unexpected time: ", when, err)
+	}
+
+	when, err = parseWhen("2d")
+	if err != nil || time.Since(when) < 47*time.Hour {
+		t.Error("Unexpected time for 2d: ", when, err)
+	}
+
+	_, err = parseWhen("last tuesday")
+	if err == nil {
+		t.Error("Expected error for unknown format")
+	}
 }
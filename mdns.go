@@ -0,0 +1,540 @@
+// Find other loftus instances on the local network with mDNS / DNS-SD.
+//
+// Clients and servers advertise a _loftus._tcp service, with TXT records
+// saying what they are (role=client or server) and which repository they
+// sync. Everyone also browses for the service, so a client with no
+// --address can find a server on the local network by itself.
+//
+// Only the small part of DNS which DNS-SD needs is implemented here:
+// PTR, SRV, TXT, A and AAAA records, in IPv4 multicast on port 5353.
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	MDNS_ADDR          = "224.0.0.251:5353"
+	MDNS_SERVICE       = "_loftus._tcp.local."
+	MDNS_TTL           = 120 // Seconds
+	MDNS_QUERY_SECS    = 300 // How often we look again
+	STATUS_BROWSE_SECS = 2   // How long "loftus status" listens for answers
+
+	ROLE_CLIENT = "client"
+	ROLE_SERVER = "server"
+
+	DNS_TYPE_A    = 1
+	DNS_TYPE_PTR  = 12
+	DNS_TYPE_TXT  = 16
+	DNS_TYPE_AAAA = 28
+	DNS_TYPE_SRV  = 33
+	DNS_CLASS_IN  = 1
+
+	DNS_CACHE_FLUSH = 0x8000 // In the class of records only we answer for
+	DNS_FLAG_QR     = 0x8000 // It's a response
+	DNS_FLAG_AA     = 0x0400 // Authoritative answer
+)
+
+// An instance of our service, somewhere on the network
+type Service struct {
+	Instance string // e.g. "laptop._loftus._tcp.local."
+	Host     string // e.g. "laptop.local."
+	Port     int
+	Addrs    []net.IP
+	Txt      map[string]string
+	Expires  time.Time // Zero TTL, a goodbye, means it's already gone
+}
+
+// Friendly name, without the service suffix
+func (self Service) Name() string {
+	return strings.TrimSuffix(self.Instance, "."+MDNS_SERVICE)
+}
+
+// host:port to connect to, preferring IPv4. Empty if we don't know an address.
+func (self Service) Addr() string {
+	if len(self.Addrs) == 0 {
+		return ""
+	}
+	best := self.Addrs[0]
+	for _, ip := range self.Addrs {
+		if ip.To4() != nil {
+			best = ip
+			break
+		}
+	}
+	return net.JoinHostPort(best.String(), strconv.Itoa(self.Port))
+}
+
+type Mdns struct {
+	group    *net.UDPAddr
+	instance string // Empty to browse without advertising
+	host     string
+	port     int
+	txt      map[string]string
+
+	lock sync.Mutex
+	conn *net.UDPConn
+	done chan bool
+}
+
+// To advertise ourselves as name, on port, with txt records.
+// An empty name only browses.
+func NewMdns(name string, port int, txt map[string]string) *Mdns {
+
+	hostName, _ := os.Hostname()
+	mdns := &Mdns{
+		host: dnsLabel(strings.Split(hostName, ".")[0]) + ".local.",
+		port: port,
+		txt:  txt,
+		done: make(chan bool)}
+	mdns.group, _ = net.ResolveUDPAddr("udp4", MDNS_ADDR)
+
+	if len(name) != 0 {
+		mdns.instance = dnsLabel(name) + "." + MDNS_SERVICE
+	}
+	return mdns
+}
+
+// Join the mDNS group, announce ourselves, and look for others.
+// Every instance we hear about goes on found, until Close.
+func (self *Mdns) Start(found chan Service) error {
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, self.group)
+	if err != nil {
+		return errors.New("mDNS: " + err.Error())
+	}
+	// Go turns loopback off, but others on this machine (e.g. 'loftus status')
+	// need to hear us. Answers must come from port 5353, so it has to be this socket.
+	err = setMulticastLoop(conn)
+	if err != nil {
+		conn.Close()
+		return errors.New("mDNS: " + err.Error())
+	}
+	self.lock.Lock()
+	self.conn = conn
+	self.lock.Unlock()
+
+	go self.listen(found)
+
+	if len(self.instance) != 0 {
+		self.send(self.response(MDNS_TTL, 0), self.group)
+	}
+	self.query()
+
+	go func() {
+		ticker := time.NewTicker(MDNS_QUERY_SECS * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-self.done:
+				return
+			case <-ticker.C:
+				self.query()
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Say goodbye, and stop
+func (self *Mdns) Close() error {
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	select {
+	case <-self.done:
+		return nil
+	default:
+		close(self.done)
+	}
+	if self.conn == nil {
+		return nil
+	}
+	if len(self.instance) != 0 {
+		self.conn.WriteToUDP(self.response(0, 0), self.group)
+	}
+	return self.conn.Close()
+}
+
+// Ask who provides our service
+func (self *Mdns) query() {
+	msg := dnsHeader(0, 0, 1, 0)
+	msg = append(msg, dnsName(MDNS_SERVICE)...)
+	msg = binary.BigEndian.AppendUint16(msg, DNS_TYPE_PTR)
+	msg = binary.BigEndian.AppendUint16(msg, DNS_CLASS_IN)
+	self.send(msg, self.group)
+}
+
+func (self *Mdns) send(msg []byte, to *net.UDPAddr) {
+	self.lock.Lock()
+	conn := self.conn
+	self.lock.Unlock()
+
+	_, err := conn.WriteToUDP(msg, to)
+	if err != nil {
+		log.Println("mDNS send:", err)
+	}
+}
+
+// Answer questions about us, and pass on answers about others
+func (self *Mdns) listen(found chan Service) {
+
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := self.conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Println("mDNS read:", err)
+			continue
+		}
+
+		msg, err := parseDns(buf[:n])
+		if err != nil {
+			continue // Not for us to worry about
+		}
+
+		if !msg.isResponse {
+			if len(self.instance) != 0 && self.isAskingForUs(msg) {
+				if from.Port == self.group.Port {
+					self.send(self.response(MDNS_TTL, 0), self.group)
+				} else {
+					// A simple resolver asking directly, so answer it directly
+					self.send(self.response(MDNS_TTL, msg.id), from)
+				}
+			}
+			continue
+		}
+
+		for _, service := range msg.services() {
+			if service.Instance == self.instance {
+				continue
+			}
+			select {
+			case found <- service:
+			case <-self.done:
+				return
+			}
+		}
+	}
+}
+
+func (self *Mdns) isAskingForUs(msg *dnsMessage) bool {
+	for _, question := range msg.questions {
+		name := strings.ToLower(question)
+		if name == MDNS_SERVICE || name == strings.ToLower(self.instance) || name == strings.ToLower(self.host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Everything about us, in one packet. A zero ttl says goodbye.
+func (self *Mdns) response(ttl uint32, id uint16) []byte {
+
+	addrs := localAddrs()
+	msg := dnsHeader(id, DNS_FLAG_QR|DNS_FLAG_AA, 0, 3+len(addrs))
+
+	msg = appendRecord(msg, MDNS_SERVICE, DNS_TYPE_PTR, DNS_CLASS_IN, ttl, dnsName(self.instance))
+
+	srv := binary.BigEndian.AppendUint16(nil, 0) // Priority
+	srv = binary.BigEndian.AppendUint16(srv, 0)  // Weight
+	srv = binary.BigEndian.AppendUint16(srv, uint16(self.port))
+	srv = append(srv, dnsName(self.host)...)
+	msg = appendRecord(msg, self.instance, DNS_TYPE_SRV, DNS_CLASS_IN|DNS_CACHE_FLUSH, ttl, srv)
+
+	var txt []byte
+	for key, value := range self.txt {
+		entry := key + "=" + value
+		txt = append(txt, byte(len(entry)))
+		txt = append(txt, entry...)
+	}
+	if len(txt) == 0 {
+		txt = []byte{0} // A TXT record must have at least one, maybe empty, string
+	}
+	msg = appendRecord(msg, self.instance, DNS_TYPE_TXT, DNS_CLASS_IN|DNS_CACHE_FLUSH, ttl, txt)
+
+	for _, ip := range addrs {
+		if ip4 := ip.To4(); ip4 != nil {
+			msg = appendRecord(msg, self.host, DNS_TYPE_A, DNS_CLASS_IN|DNS_CACHE_FLUSH, ttl, ip4)
+		} else {
+			msg = appendRecord(msg, self.host, DNS_TYPE_AAAA, DNS_CLASS_IN|DNS_CACHE_FLUSH, ttl, ip.To16())
+		}
+	}
+	return msg
+}
+
+// Look for instances of our service for 'wait', once
+func browse(wait time.Duration) ([]Service, error) {
+
+	mdns := NewMdns("", 0, nil)
+	found := make(chan Service)
+	err := mdns.Start(found)
+	if err != nil {
+		return nil, err
+	}
+	defer mdns.Close()
+
+	byName := make(map[string]Service)
+	var names []string
+	timeout := time.After(wait)
+	for {
+		select {
+		case service := <-found:
+			if _, ok := byName[service.Instance]; !ok {
+				names = append(names, service.Instance)
+			}
+			byName[service.Instance] = service
+		case <-timeout:
+			var services []Service
+			for _, name := range names {
+				if byName[name].Expires.After(time.Now()) {
+					services = append(services, byName[name])
+				}
+			}
+			return services, nil
+		}
+	}
+}
+
+func setMulticastLoop(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// Our addresses which others on the network could reach us at
+func localAddrs() []net.IP {
+	var ips []net.IP
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips
+}
+
+// Make name usable as a single DNS label
+func dnsLabel(name string) string {
+	name = strings.ReplaceAll(name, ".", "-")
+	if len(name) > 63 {
+		name = name[:63]
+	}
+	return name
+}
+
+/*
+ * DNS messages
+ */
+
+type dnsRecord struct {
+	name  string
+	rtype uint16
+	ttl   uint32
+	data  []byte
+	start int // Offset of data in the message, for compressed names in it
+}
+
+type dnsMessage struct {
+	id         uint16
+	isResponse bool
+	questions  []string // Names asked about
+	records    []dnsRecord
+	raw        []byte
+}
+
+func dnsHeader(id uint16, flags uint16, questions int, answers int) []byte {
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = binary.BigEndian.AppendUint16(msg, flags)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(questions))
+	msg = binary.BigEndian.AppendUint16(msg, uint16(answers))
+	msg = binary.BigEndian.AppendUint16(msg, 0)  // Authority
+	return binary.BigEndian.AppendUint16(msg, 0) // Additional
+}
+
+// A name in DNS wire format, uncompressed. "a.b." is 1 a 1 b 0
+func dnsName(name string) []byte {
+	var out []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 {
+			continue
+		}
+		out = append(out, byte(len(label)))
+		out = append(out, label...)
+	}
+	return append(out, 0)
+}
+
+func appendRecord(msg []byte, name string, rtype uint16, class uint16, ttl uint32, data []byte) []byte {
+	msg = append(msg, dnsName(name)...)
+	msg = binary.BigEndian.AppendUint16(msg, rtype)
+	msg = binary.BigEndian.AppendUint16(msg, class)
+	msg = binary.BigEndian.AppendUint32(msg, ttl)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(data)))
+	return append(msg, data...)
+}
+
+var errDnsShort = errors.New("DNS message too short")
+
+// Read a possibly compressed name at offset. Returns the name and the offset after it.
+func readDnsName(msg []byte, offset int) (string, int, error) {
+
+	var labels []string
+	end := -1 // Where the name ends in the message, once we follow a pointer
+	for jumps := 0; jumps < 20; jumps++ {
+		if offset >= len(msg) {
+			return "", 0, errDnsShort
+		}
+		length := int(msg[offset])
+
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+
+		case length&0xC0 == 0xC0: // Pointer to a name earlier in the message
+			if offset+1 >= len(msg) {
+				return "", 0, errDnsShort
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3FFF)
+
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, errDnsShort
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+			jumps--
+		}
+	}
+	return "", 0, errors.New("DNS name has too many pointers")
+}
+
+func parseDns(msg []byte) (*dnsMessage, error) {
+
+	if len(msg) < 12 {
+		return nil, errDnsShort
+	}
+	parsed := &dnsMessage{
+		id:         binary.BigEndian.Uint16(msg),
+		isResponse: binary.BigEndian.Uint16(msg[2:])&DNS_FLAG_QR != 0,
+		raw:        msg}
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	records := int(binary.BigEndian.Uint16(msg[6:])) +
+		int(binary.BigEndian.Uint16(msg[8:])) +
+		int(binary.BigEndian.Uint16(msg[10:]))
+
+	offset := 12
+	for i := 0; i < questions; i++ {
+		name, next, err := readDnsName(msg, offset)
+		if err != nil {
+			return nil, err
+		}
+		parsed.questions = append(parsed.questions, name)
+		offset = next + 4 // Type and class
+	}
+
+	for i := 0; i < records; i++ {
+		name, next, err := readDnsName(msg, offset)
+		if err != nil {
+			return nil, err
+		}
+		if next+10 > len(msg) {
+			return nil, errDnsShort
+		}
+		length := int(binary.BigEndian.Uint16(msg[next+8:]))
+		if next+10+length > len(msg) {
+			return nil, errDnsShort
+		}
+		parsed.records = append(parsed.records, dnsRecord{
+			name:  name,
+			rtype: binary.BigEndian.Uint16(msg[next:]),
+			ttl:   binary.BigEndian.Uint32(msg[next+4:]),
+			data:  msg[next+10 : next+10+length],
+			start: next + 10})
+		offset = next + 10 + length
+	}
+
+	return parsed, nil
+}
+
+// Instances of our service described in this response
+func (self *dnsMessage) services() []Service {
+
+	var services []Service
+	for _, ptr := range self.records {
+		if ptr.rtype != DNS_TYPE_PTR || !strings.EqualFold(ptr.name, MDNS_SERVICE) {
+			continue
+		}
+		instance, _, err := readDnsName(self.raw, ptr.start)
+		if err != nil {
+			continue
+		}
+
+		service := Service{
+			Instance: instance,
+			Txt:      make(map[string]string),
+			Expires:  time.Now().Add(time.Duration(ptr.ttl) * time.Second)}
+
+		for _, record := range self.records {
+			if !strings.EqualFold(record.name, instance) {
+				continue
+			}
+			switch record.rtype {
+			case DNS_TYPE_SRV:
+				if len(record.data) < 7 {
+					continue
+				}
+				service.Port = int(binary.BigEndian.Uint16(record.data[4:]))
+				service.Host, _, _ = readDnsName(self.raw, record.start+6)
+			case DNS_TYPE_TXT:
+				for data := record.data; len(data) != 0 && int(data[0]) < len(data); data = data[1+data[0]:] {
+					key, value, _ := strings.Cut(string(data[1:1+data[0]]), "=")
+					service.Txt[key] = value
+				}
+			}
+		}
+
+		for _, record := range self.records {
+			if !strings.EqualFold(record.name, service.Host) {
+				continue
+			}
+			if record.rtype == DNS_TYPE_A && len(record.data) == 4 ||
+				record.rtype == DNS_TYPE_AAAA && len(record.data) == 16 {
+				// Copy, the message buffer gets reused
+				service.Addrs = append(service.Addrs, net.IP(append([]byte(nil), record.data...)))
+			}
+		}
+
+		services = append(services, service)
+	}
+	return services
+}
@@ -0,0 +1,217 @@
+// Host specific versions of files.
+//
+// A file called '.xprofile##host=laptop' appears as '.xprofile' on the machine
+// called laptop. Conditions are host=, user= and os=, comma separated to
+// require several. '.xprofile##default' is used where nothing else matches.
+//
+// The canonical name is a symlink to the chosen variant, so edits change the
+// variant and sync as normal. The symlink itself is never committed.
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+const (
+	OVERRIDE_SEP     = "##"
+	OVERRIDE_DEFAULT = "default"
+
+	EXCLUDE_START = "# loftus overrides start. Do not edit this block."
+	EXCLUDE_END   = "# loftus overrides end"
+)
+
+// How much a matching condition counts. The most specific variant wins.
+var OVERRIDE_SCORE = map[string]int{
+	"host": 4,
+	"user": 2,
+	"os":   1,
+}
+
+// Make every canonical name point to the right variant for this machine.
+// variants are by canonical name, see findGenerated. Returns the canonical names.
+func (self *GitBackend) applyOverrides(variants map[string][]string) []string {
+
+	var canonicals []string
+	for canonical, candidates := range variants {
+
+		canonicals = append(canonicals, canonical)
+
+		best := self.bestVariant(candidates)
+		err := self.linkVariant(canonical, best)
+		if err != nil {
+			log.Println("Override", canonical, err)
+		}
+	}
+
+	return canonicals
+}
+
+// Find every variant and template in one walk of the repository, which
+// can be big. Returns the variants by their canonical name, and the
+// templates. Paths are relative to rootDir.
+func (self *GitBackend) findGenerated() (map[string][]string, []string, error) {
+
+	variants := make(map[string][]string)
+	var templates []string
+
+	findOne := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && isGit(path) {
+			return filepath.SkipDir
+		}
+
+		name := info.Name()
+		if info.IsDir() || !strings.Contains(name, OVERRIDE_SEP) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(self.rootDir, path)
+		if err != nil {
+			return err
+		}
+
+		if strings.HasSuffix(name, TEMPLATE_SUFFIX) {
+			templates = append(templates, rel)
+			return nil
+		}
+
+		// Only the file's name, a directory's name may have OVERRIDE_SEP too
+		canonical := filepath.Join(filepath.Dir(rel), name[:strings.Index(name, OVERRIDE_SEP)])
+		variants[canonical] = append(variants[canonical], rel)
+		return nil
+	}
+
+	err := filepath.Walk(self.rootDir, findOne)
+	return variants, templates, err
+}
+
+// The variant which best matches this machine, or empty string if none do
+func (self *GitBackend) bestVariant(candidates []string) string {
+
+	sort.Strings(candidates)
+
+	best := ""
+	bestScore := -1
+
+	for _, candidate := range candidates {
+		name := filepath.Base(candidate)
+		score := self.overrideScore(name[strings.Index(name, OVERRIDE_SEP)+len(OVERRIDE_SEP):])
+		if score > bestScore {
+			best = candidate
+			bestScore = score
+		}
+	}
+	return best
+}
+
+// How well conditions such as 'host=laptop,os=linux' match this machine.
+// -1 means they don't match.
+func (self *GitBackend) overrideScore(conditions string) int {
+
+	if conditions == OVERRIDE_DEFAULT {
+		return 0
+	}
+
+	actual := map[string]string{
+		"host": self.hostName,
+		"user": self.userName,
+		"os":   runtime.GOOS,
+	}
+
+	score := 0
+	for _, condition := range strings.Split(conditions, ",") {
+
+		conditionParts := strings.SplitN(condition, "=", 2)
+		if len(conditionParts) != 2 || actual[conditionParts[0]] != conditionParts[1] {
+			return -1
+		}
+		score += OVERRIDE_SCORE[conditionParts[0]]
+	}
+	return score
+}
+
+// Make canonical a symlink to variant, or remove our symlink if variant is empty.
+// A real file at the canonical name is left alone.
+func (self *GitBackend) linkVariant(canonical string, variant string) error {
+
+	path := filepath.Join(self.rootDir, canonical)
+	target := filepath.Base(variant)
+
+	info, err := os.Lstat(path)
+	if err == nil && info.Mode()&os.ModeSymlink == 0 {
+		log.Println("Not overriding", canonical, "because it is a real file. Rename it to",
+			canonical+OVERRIDE_SEP+OVERRIDE_DEFAULT)
+		return nil
+	}
+
+	if err == nil {
+		current, _ := os.Readlink(path)
+		if current == target && len(variant) != 0 {
+			return nil
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(variant) == 0 {
+		return nil
+	}
+
+	log.Println("Linking", canonical, "to", target)
+	return os.Symlink(target, path)
+}
+
+// Tell git to ignore the canonical names, in .git/info/exclude, which isn't shared
+func (self *GitBackend) excludeCanonicals(canonicals []string) error {
+
+	sort.Strings(canonicals)
+
+	excludeFile := filepath.Join(self.rootDir, ".git", "info", "exclude")
+
+	content, err := os.ReadFile(excludeFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Keep everything outside our block
+	var lines []string
+	isOurs := false
+	for _, line := range strings.Split(strings.TrimRight(string(content), "\n"), "\n") {
+		switch {
+		case line == EXCLUDE_START:
+			isOurs = true
+		case line == EXCLUDE_END:
+			isOurs = false
+		case !isOurs && (len(line) != 0 || len(lines) != 0):
+			lines = append(lines, line)
+		}
+	}
+
+	if len(canonicals) != 0 {
+		lines = append(lines, EXCLUDE_START)
+		for _, canonical := range canonicals {
+			lines = append(lines, "/"+filepath.ToSlash(canonical))
+		}
+		lines = append(lines, EXCLUDE_END)
+	}
+
+	newContent := strings.Join(lines, "\n") + "\n"
+	if newContent == string(content) {
+		return nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(excludeFile), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(excludeFile, []byte(newContent), 0644)
+}
@@ -0,0 +1,86 @@
+// Pause syncing during bulk changes, e.g. a rebase inside the sync dir.
+//
+// While paused we keep collecting the watcher's events, but Sync does
+// nothing, so intermediate states are never committed. Resuming makes one
+// commit of everything, summarised. Pause with SIGUSR1 or 'loftus ctl pause',
+// resume with SIGUSR2 or 'loftus ctl resume', or after a timeout.
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	SIGNAL_PAUSE  = syscall.SIGUSR1
+	SIGNAL_RESUME = syscall.SIGUSR2
+)
+
+// Stop syncing. Resume automatically after timeout, unless it's 0.
+// Pausing again only changes the timeout.
+func (self *Client) pause(timeout time.Duration) {
+
+	if !self.paused {
+		self.paused = true
+		self.pausedAt = time.Now()
+	}
+
+	self.autoResume = nil // A nil channel never fires
+	self.pausedUntil = time.Time{}
+	msg := "Paused"
+	if timeout > 0 {
+		self.autoResume = time.After(timeout)
+		self.pausedUntil = time.Now().Add(timeout)
+		msg += " for " + timeout.String()
+	}
+
+	log.Println(msg)
+	self.record(msg)
+}
+
+// Start syncing again, committing everything that changed while we were paused
+func (self *Client) resume() error {
+
+	if !self.paused {
+		return nil
+	}
+	self.paused = false
+	self.autoResume = nil
+	self.pausedUntil = time.Time{}
+
+	log.Println("Resumed after", time.Since(self.pausedAt).Round(time.Second))
+	self.record("Resumed")
+	return self.syncPending(TRIGGER_RESUME)
+}
+
+// Pause or resume, as the signal asks
+func (self *Client) signalled(sig os.Signal) {
+
+	switch sig {
+	case SIGNAL_PAUSE:
+		self.pause(self.pauseTimeout)
+	case SIGNAL_RESUME:
+		err := self.resume()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Commit message for everything that changed while paused. The summary says
+// how much, and the body lists each file once, however often it changed.
+func (self *Client) resumeMsg(events []Event) string {
+
+	paths := changedPaths(self.syncDir, events)
+	summary := "Resumed after " + time.Since(self.pausedAt).Round(time.Second).String() +
+		", files changed: " + strconv.Itoa(len(paths))
+
+	if len(paths) == 0 {
+		return summary
+	}
+	return summary + "\n\n" + strings.Join(paths, "\n")
+}
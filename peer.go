@@ -0,0 +1,296 @@
+// Sync directly between clients on the local network, without a git server.
+//
+// With --peer each client serves it's repository on --peer-port, to anyone
+// who knows the shared secret, over TLS with --tls. It only runs 'git upload-pack',
+// so peers can fetch from us but never change our repository. When a peer announces
+// a change (on the local network, or when mDNS finds it) we fetch from it
+// with git's ext:: transport, which runs 'loftus peer-pipe' to connect.
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_PEER_PORT = 51235
+	PEER_REF          = "refs/remotes/loftus-peer/master" // Where we fetch peers' master to
+	UPLOAD_PACK       = "git-upload-pack"                 // The only git service we offer
+
+	// Peer to peer: please run upload-pack on your repository for me
+	MSG_UPLOAD_PACK = "upload-pack"
+)
+
+type PeerServer struct {
+	syncDir  string
+	secret   string
+	listener net.Listener
+}
+
+// Start serving syncDir on port, with TLS if tlsConf isn't nil. Secret must not be empty.
+func NewPeerServer(syncDir string, port int, secret string, tlsConf *tls.Config) (*PeerServer, error) {
+
+	if len(secret) == 0 {
+		return nil, errors.New("--peer needs a shared secret, so that only your machines can read the repository")
+	}
+
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return nil, err
+	}
+	if tlsConf != nil {
+		listener = tls.NewListener(listener, tlsConf)
+	}
+	log.Println("Serving", syncDir, "to peers on port", port)
+
+	server := &PeerServer{syncDir: syncDir, secret: secret, listener: listener}
+	go server.serve()
+	return server, nil
+}
+
+// The port we're listening on
+func (self *PeerServer) Port() int {
+	return self.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (self *PeerServer) Close() error {
+	return self.listener.Close()
+}
+
+func (self *PeerServer) serve() {
+	for {
+		conn, err := self.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Println("Peer accept:", err)
+			continue
+		}
+		go self.handle(conn)
+	}
+}
+
+// Authenticate the peer, then let it fetch
+func (self *PeerServer) handle(conn net.Conn) {
+
+	defer conn.Close()
+
+	bufRead := bufio.NewReader(conn)
+	err := serverHandshake(conn, bufRead, self.secret)
+	if err != nil {
+		log.Println("Rejected peer", conn.RemoteAddr(), err)
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(HANDSHAKE_SECS * time.Second))
+	line, err := bufRead.ReadString('\n')
+	if err != nil {
+		log.Println("Peer", conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	request, err := decodeMessage(line)
+	if err != nil || request.Type != MSG_UPLOAD_PACK {
+		log.Println("Peer", conn.RemoteAddr(), "sent an unexpected request:", line)
+		return
+	}
+
+	log.Println("Peer", conn.RemoteAddr(), "is fetching from us")
+
+	cmd := exec.Command("git", "upload-pack", "--timeout=60", self.syncDir)
+	cmd.Stdout = conn
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		log.Println("Peer", conn.RemoteAddr(), "upload-pack:", err)
+		return
+	}
+
+	// Our copy, not cmd.Stdin, because Wait would wait for it, and only the
+	// peer knows when it's done. Closing conn when we return ends it.
+	// bufRead, not conn, in case it already read some of git's conversation.
+	go func() {
+		io.Copy(stdin, bufRead)
+		stdin.Close()
+	}()
+
+	err = cmd.Wait()
+	if err != nil {
+		log.Println("Peer", conn.RemoteAddr(), "upload-pack:", err)
+	}
+}
+
+// loftus peer-pipe <address> git-upload-pack
+//
+// Not for people. Git runs it for the ext:: transport (see peerUrl), and talks
+// to the peer's upload-pack through our stdin and stdout.
+func peerPipeCmd(config *Config) error {
+
+	if len(config.args) != 2 || config.args[1] != UPLOAD_PACK {
+		return errors.New("Usage: loftus peer-pipe <address> " + UPLOAD_PACK)
+	}
+	addr := config.args[0]
+
+	var tlsConf *tls.Config
+	if config.isTls {
+		var err error
+		tlsConf, err = clientTlsConfig(config, addr)
+		if err != nil {
+			return err
+		}
+	}
+
+	conn, bufRead, err := getRemoteConnection(addr, tlsConf, config.loadSecret(), "peer-pipe")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = tcpSend(conn, NewMessage(MSG_UPLOAD_PACK, "", "", "").Encode())
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		io.Copy(conn, os.Stdin)
+		// Tell upload-pack we're done, but keep reading it's answer
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.CloseWrite()
+		}
+	}()
+
+	_, err = io.Copy(os.Stdout, bufRead)
+	return err
+}
+
+// Flags for 'loftus peer-pipe', so it connects to peers the way we would
+func peerPipeArgs(config *Config) []string {
+	args := []string{"--secret-file=" + config.secretFile}
+	if config.isTls {
+		args = append(args, "--tls")
+	}
+	if len(config.tlsCa) != 0 {
+		args = append(args, "--tls-ca="+config.tlsCa)
+	}
+	return args
+}
+
+// A git URL which fetches from the peer at addr, through 'loftus peer-pipe' with args
+func peerUrl(args []string, addr string) (string, error) {
+
+	executable, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+
+	url := "ext::" + extArg(executable)
+	for _, arg := range args {
+		url += " " + extArg(arg)
+	}
+	return url + " peer-pipe " + extArg(addr) + " %S", nil
+}
+
+// Escape an argument for an ext:: URL, where spaces separate arguments
+// and % starts a placeholder
+func extArg(arg string) string {
+	arg = strings.ReplaceAll(arg, "%", "%%")
+	return strings.ReplaceAll(arg, " ", "% ")
+}
+
+// Fetch master from the peer at addr, and bring it in. Only a fast-forward,
+// or a clean merge of history we share, so a peer can add commits but never
+// replace ours. peer-pipe already checked the peer knows our secret.
+func (self *GitBackend) PullPeer(addr string) error {
+
+	url, err := peerUrl(self.peerArgs, addr)
+	if err != nil {
+		return err
+	}
+
+	// ext:: runs a command, so git only allows it when asked
+	_, err = self.gitOutput("-c", "protocol.ext.allow=always", "fetch", "--no-tags", url, "+master:"+PEER_REF)
+	if err != nil {
+		return err
+	}
+
+	// Nothing we don't have
+	_, err = self.gitOutput("merge-base", "--is-ancestor", PEER_REF, "HEAD")
+	if err == nil {
+		return nil
+	}
+
+	_, err = self.gitOutput("merge-base", "--is-ancestor", "HEAD", PEER_REF)
+	if err == nil {
+		_, err = self.gitOutput("merge", "--ff-only", PEER_REF)
+	} else {
+		err = self.mergePeer()
+	}
+	if err != nil {
+		return err
+	}
+
+	self.updateGenerated()
+	return nil
+}
+
+// We and the peer both have new commits. Merge, if it's the same repository
+// and there's no conflict. Otherwise leave things as they were.
+func (self *GitBackend) mergePeer() error {
+
+	ourId, err := self.RepoId()
+	if err != nil {
+		return err
+	}
+	roots, err := self.gitOutput("rev-list", "--max-parents=0", PEER_REF)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(roots, ourId) {
+		return errors.New("peer's master isn't from our repository, not merging it")
+	}
+
+	// Exit status 1 is a conflict here, so don't use self.git
+	output, err := self.gitOutput("merge", "--no-edit", PEER_REF)
+	log.Println(output)
+	if err != nil {
+		self.git("merge", "--abort")
+		return err
+	}
+	return nil
+}
+
+// Bring in a peer's changes. Our own are already committed (by Sync),
+// so this is a fast-forward or a merge. Callers tell the user what changed.
+func (self *Client) pullPeer(addr string) {
+
+	if self.paused {
+		return // Resume pulls from the server, or the peer's next update will
+	}
+
+	err := self.backend.PullPeer(addr)
+	if err != nil {
+		log.Println("Pulling from peer", addr, err)
+		return
+	}
+
+	if self.isOnline {
+		err = self.backend.Push()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
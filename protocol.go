@@ -0,0 +1,125 @@
+// Messages between clients and server, one JSON object per line
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+const (
+	PROTOCOL_VERSION = 1
+
+	// Something was pushed, sync if you don't have Head
+	MSG_UPDATE = "update"
+
+	// Checking the connection works, ignore
+	MSG_TEST = "test"
+
+	// Client to server: only send me messages for Repo
+	MSG_SUBSCRIBE = "subscribe"
+
+	// Heartbeat. Client sends ping, server answers pong.
+	MSG_PING = "ping"
+	MSG_PONG = "pong"
+
+	// Paths an update lists by name, the rest are counted
+	MAX_MSG_PATHS = 10
+)
+
+type Message struct {
+	Version int    `json:"v"`
+	Type    string `json:"type"`
+	Repo    string `json:"repo,omitempty"`   // Storage.RepoId
+	Sender  string `json:"sender,omitempty"` // Random per process, to ignore our own messages
+	Head    string `json:"head,omitempty"`   // Revision after the change
+	Nonce   string `json:"nonce,omitempty"`  // Challenge, from either side, see auth.go
+	Mac     string `json:"mac,omitempty"`    // Answer to the other side's challenge
+	Peer    string `json:"peer,omitempty"`   // host:port where the sender serves it's repository
+
+	Host  string   `json:"host,omitempty"`  // Sender's --host, to tell the user who changed things
+	Paths []string `json:"paths,omitempty"` // Files the update changed, relative to the sync dir
+	More  int      `json:"more,omitempty"`  // How many changed files aren't in Paths
+}
+
+func NewMessage(msgType string, repo string, sender string, head string) *Message {
+	return &Message{
+		Version: PROTOCOL_VERSION,
+		Type:    msgType,
+		Repo:    repo,
+		Sender:  sender,
+		Head:    head}
+}
+
+// The message as a line of JSON
+func (self *Message) Encode() string {
+	line, _ := json.Marshal(self) // Can't fail, all fields are strings, ints or lists of strings
+	return string(line) + "\n"
+}
+
+// Say which files changed, listing at most MAX_MSG_PATHS of them, and only as
+// many as keep the message in one LAN packet. A longer one would arrive cut
+// short, and be dropped. Set the other fields first.
+func (self *Message) SetPaths(paths []string) {
+	self.Paths = paths
+	self.More = 0
+	if len(paths) > MAX_MSG_PATHS {
+		self.Paths = paths[:MAX_MSG_PATHS]
+		self.More = len(paths) - MAX_MSG_PATHS
+	}
+	for len(self.Paths) != 0 && len(self.Encode()) > LAN_PACKET_SIZE {
+		self.Paths = self.Paths[:len(self.Paths)-1]
+		self.More++
+	}
+	if len(self.Paths) == 0 {
+		self.Paths = nil
+	}
+}
+
+// Summary of an update for the user, e.g. "laptop changed .vimrc, 2 others"
+func (self *Message) Describe() string {
+
+	host := self.Host
+	if len(host) == 0 {
+		host = "Another machine"
+	}
+	if len(self.Paths) == 0 {
+		return host + " changed something"
+	}
+
+	desc := host + " changed " + self.Paths[0]
+	switch others := len(self.Paths) - 1 + self.More; others {
+	case 0:
+	case 1:
+		desc += ", 1 other"
+	default:
+		desc += ", " + strconv.Itoa(others) + " others"
+	}
+	return desc
+}
+
+// Parse a line of JSON. Messages from other protocol versions are an error.
+func decodeMessage(line string) (*Message, error) {
+
+	msg := &Message{}
+	err := json.Unmarshal([]byte(line), msg)
+	if err != nil {
+		return nil, errors.New("Invalid message: " + line)
+	}
+
+	if msg.Version != PROTOCOL_VERSION {
+		return nil, errors.New("Unsupported protocol version " + strconv.Itoa(msg.Version) +
+			", we speak " + strconv.Itoa(PROTOCOL_VERSION))
+	}
+
+	return msg, nil
+}
+
+// Random identifier for this process
+func newSenderId() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -2,23 +2,86 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"errors"
 	"io"
 	"log"
 	"net"
+	"os"
+	"strconv"
+	"time"
 )
 
 /* Create and start a server */
 func startServer(config *Config) {
 
 	addr := config.serverAddr
-	server := Server{addr: addr}
+	tlsConf, err := serverTlsConfig(config)
+	if err != nil {
+		log.Fatal("Error setting up TLS: " + err.Error())
+	}
+
+	server := NewServer(addr, config.socketPath, config.loadSecret(), tlsConf)
+	server.timeout = config.heartbeat.Timeout
 	log.Println("Listening on", addr)
+	go server.listenLocal()
+
+	if config.isMdns {
+		mdns, err := advertiseServer(config)
+		if err != nil {
+			log.Println(err)
+		} else {
+			defer mdns.Close()
+		}
+	}
+
 	server.listen()
 }
 
 type Server struct {
-	connections []net.Conn
-	addr        string
+	hub        *Hub
+	addr       string
+	socketPath string        // Unix socket for the git post-receive hook
+	secret     string        // Clients must prove they know it. Empty means anyone can connect.
+	tlsConf    *tls.Config   // nil for plain TCP
+	timeout    time.Duration // Drop clients we don't hear from (not even a ping) for this long
+}
+
+func NewServer(addr string, socketPath string, secret string, tlsConf *tls.Config) *Server {
+	return &Server{
+		hub:        NewHub(),
+		addr:       addr,
+		socketPath: socketPath,
+		secret:     secret,
+		tlsConf:    tlsConf,
+		timeout:    DEFAULT_HEARTBEAT_TIMEOUT}
+}
+
+// Tell clients on the local network where we are
+func advertiseServer(config *Config) (*Mdns, error) {
+
+	_, portStr, err := net.SplitHostPort(config.serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, errors.New("Bad port in " + config.serverAddr)
+	}
+
+	txt := map[string]string{"v": strconv.Itoa(PROTOCOL_VERSION), "role": ROLE_SERVER}
+	if config.isTls {
+		txt["tls"] = "1"
+	}
+
+	mdns := NewMdns(config.hostName+"-server", port, txt)
+	// We don't care who else is out there, but must read what mDNS sends us
+	found := make(chan Service)
+	go func() {
+		for range found {
+		}
+	}()
+	return mdns, mdns.Start(found)
 }
 
 // Listen for new connections
@@ -28,49 +91,130 @@ func (self *Server) listen() {
 	if err != nil {
 		log.Fatal("Error on listen: " + err.Error())
 	}
+	log.Fatal("Error on accept: " + self.serve(listener).Error())
+}
+
+// Accept connections on listener until it fails
+func (self *Server) serve(listener net.Listener) error {
+
+	if self.tlsConf != nil {
+		log.Println("Using TLS")
+		listener = tls.NewListener(listener, self.tlsConf)
+	}
 	defer listener.Close()
 
 	for {
 		conn, err := listener.Accept()
-		log.Println("New connection")
 		if err != nil {
-			log.Fatal("Error on accept: " + err.Error())
+			return err
 		}
-
-		self.connections = append(self.connections, conn)
+		log.Println("New connection from", conn.RemoteAddr())
 
 		go self.handle(conn)
 	}
 }
 
-// Read from this connection, and echo to all others
+// Read from this connection, and echo updates to everyone in the same repository
 func (self *Server) handle(conn net.Conn) {
 
+	bufRead := bufio.NewReader(conn)
+	err := serverHandshake(conn, bufRead, self.secret)
+	if err != nil {
+		log.Println("Rejected connection from", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	peer := self.hub.Join(conn)
+	defer self.hub.Leave(peer)
+
 	for {
-		bufRead := bufio.NewReader(conn)
+		conn.SetReadDeadline(time.Now().Add(self.timeout))
 		content, err := bufRead.ReadString('\n')
-
-		if err == io.EOF {
-			conn.Close()
-			// Delete ourself from self.connections and leave go-routine
-			newConnections := make([]net.Conn, 0, len(self.connections)-1)
-			for _, candidate := range self.connections {
-				if candidate != conn {
-					newConnections = append(newConnections, candidate)
-				}
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				log.Println("No heartbeat from", conn.RemoteAddr(), "dropping it")
+			} else if err != io.EOF {
+				log.Println("Error reading from", conn.RemoteAddr(), err)
 			}
-			self.connections = newConnections
 			return
 		}
 
-		log.Println("Echoing: ", content)
-		for _, outConn := range self.connections {
-			log.Println("Comparing", outConn, "and", conn)
-			if outConn != conn {
-				log.Println("different, echoing")
-				outConn.Write([]byte(content))
-			}
+		msg, err := decodeMessage(content)
+		if err != nil {
+			log.Println("From", conn.RemoteAddr(), err)
+			continue
+		}
+
+		switch msg.Type {
+
+		case MSG_PING:
+			peer.Reply(NewMessage(MSG_PONG, "", "", "").Encode())
+
+		case MSG_SUBSCRIBE:
+			log.Println(conn.RemoteAddr(), "subscribed to", msg.Repo)
+			self.hub.Subscribe(peer, msg.Repo)
+
+		case MSG_UPDATE:
+			// A new repository only gets an id on it's first commit,
+			// so it's first update is also it's subscription.
+			self.hub.Subscribe(peer, msg.Repo)
+			log.Println("Echoing: ", content)
+			self.hub.Broadcast(msg.Encode(), msg.Repo, peer)
 		}
 	}
+}
+
+// Listen on a unix socket for notifications from the git post-receive hook
+// (see 'loftus notify'), and tell every client. This catches pushes made
+// with plain 'git push', or by a client which isn't connected to us.
+func (self *Server) listenLocal() {
+
+	// A previous run may have left it behind
+	os.Remove(self.socketPath)
+
+	listener, err := net.Listen("unix", self.socketPath)
+	if err != nil {
+		log.Fatal("Error on local listen: " + err.Error())
+	}
+	defer listener.Close()
+
+	// Only our user (who owns the repository) can notify
+	err = os.Chmod(self.socketPath, 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("Listening for git hook on", self.socketPath)
 
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Fatal("Error on local accept: " + err.Error())
+		}
+		go self.handleLocal(conn)
+	}
+}
+
+// Read update messages from 'loftus notify', and pass them to the clients
+func (self *Server) handleLocal(conn net.Conn) {
+
+	defer conn.Close()
+	bufRead := bufio.NewReader(conn)
+
+	for {
+		line, err := bufRead.ReadString('\n')
+		if len(line) != 0 {
+			msg, decodeErr := decodeMessage(line)
+			if decodeErr != nil {
+				log.Println("From git hook:", decodeErr)
+			} else {
+				log.Println("Push to", msg.Repo, "now at", msg.Head)
+				self.hub.Broadcast(msg.Encode(), msg.Repo, nil)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
 }
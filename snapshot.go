@@ -0,0 +1,178 @@
+// Named snapshots of the whole tree, stored as tags
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	SNAPSHOT_PREFIX  = "snapshot/"
+	TRIGGER_SNAPSHOT = "Snapshot"
+)
+
+var NOT_SLUG = regexp.MustCompile("[^a-z0-9]+")
+
+// A named point in history
+type Snapshot struct {
+	Name  string // As the user gave it
+	Label string // Name usable as a tag
+	Id    string
+	When  time.Time
+}
+
+// loftus snapshot <name>
+//
+// Commit anything pending and label the current state, so we can get back to it.
+func snapshotCmd(config *Config) error {
+
+	if len(config.args) != 1 {
+		return errors.New("Usage: loftus snapshot <name>")
+	}
+	name := config.args[0]
+
+	backend, err := commandBackend(config)
+	if err != nil {
+		return err
+	}
+
+	meta := CommitMeta{
+		Host:    config.hostName,
+		User:    os.Getenv("USER"),
+		Version: VERSION,
+		Trigger: TRIGGER_SNAPSHOT,
+	}
+
+	err = backend.AddAll()
+	if err != nil {
+		return err
+	}
+
+	err = backend.Commit(meta.Format("Snapshot: " + name))
+	if err != nil {
+		return err
+	}
+
+	err = backend.Snapshot(name)
+	if err != nil {
+		return err
+	}
+
+	if backend.IsOnline() {
+		return backend.Push()
+	}
+	return nil
+}
+
+// loftus snapshots
+//
+// List snapshots, oldest first
+func snapshotsCmd(config *Config) error {
+
+	backend, err := commandBackend(config)
+	if err != nil {
+		return err
+	}
+
+	snapshots, err := backend.Snapshots()
+	if err != nil {
+		return err
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, snap := range snapshots {
+		fmt.Fprintf(out, "%s\t%s\t%s\t%s\n",
+			snap.When.Format("2006-01-02 15:04"), shortId(snap.Id), snap.Label, snap.Name)
+	}
+	return out.Flush()
+}
+
+// loftus rollback <name>
+//
+// Put the whole tree back as it was at a snapshot. Like restore, the running
+// client records this as a new change, so it can be undone.
+func rollbackCmd(config *Config) error {
+
+	if len(config.args) != 1 {
+		return errors.New("Usage: loftus rollback <snapshot>")
+	}
+
+	backend, err := commandBackend(config)
+	if err != nil {
+		return err
+	}
+
+	return backend.Rollback(config.args[0])
+}
+
+// Name of a snapshot usable as a tag: 'Before i3 upgrade' becomes 'before-i3-upgrade'
+func snapshotLabel(name string) string {
+	return strings.Trim(NOT_SLUG.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+// Run: git tag --annotate snapshot/<label> --message=<name>
+func (self *GitBackend) Snapshot(name string) error {
+
+	label := snapshotLabel(name)
+	if len(label) == 0 {
+		return errors.New("Snapshot name needs some letters or numbers: " + name)
+	}
+
+	_, err := self.gitOutput("tag", "--annotate", SNAPSHOT_PREFIX+label, "--message="+name)
+	return err
+}
+
+// Run: git for-each-ref refs/tags/snapshot/
+func (self *GitBackend) Snapshots() ([]Snapshot, error) {
+
+	output, err := self.gitOutput(
+		"for-each-ref",
+		"--sort=creatordate",
+		"--format=%(refname:strip=3)%1f%(*objectname)%1f%(creatordate:unix)%1f%(contents:subject)",
+		"refs/tags/"+SNAPSHOT_PREFIX)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []Snapshot
+	for _, line := range strings.Split(output, "\n") {
+
+		fields := strings.Split(line, "\x1f")
+		if len(fields) != 4 {
+			continue
+		}
+
+		timestamp, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		snapshots = append(snapshots, Snapshot{
+			Label: fields[0],
+			Id:    fields[1],
+			When:  time.Unix(timestamp, 0),
+			Name:  fields[3]})
+	}
+
+	return snapshots, nil
+}
+
+// Run: git read-tree -u --reset snapshot/<label>
+// Changes the working directory, and index, to match the snapshot.
+func (self *GitBackend) Rollback(name string) error {
+
+	tag := SNAPSHOT_PREFIX + snapshotLabel(name)
+	_, err := self.gitOutput("rev-parse", "--verify", "--quiet", tag)
+	if err != nil {
+		return errors.New("No snapshot called " + name + ". Try 'loftus snapshots'.")
+	}
+
+	_, err = self.gitOutput("read-tree", "-u", "--reset", tag)
+	return err
+}
@@ -0,0 +1,283 @@
+// Files rendered per machine from a template.
+//
+// '.gitconfig##template' is a Go text/template, rendered as '.gitconfig'.
+// It can use {{ .Host }}, {{ .User }}, {{ .OS }}, {{ .Home }} and
+// {{ .Var.name }} for variables given with --var name=value.
+//
+// Edits to the rendered file are copied back to the template when we can
+// tell which template line they belong to. Otherwise it's a conflict: we
+// alert the user and leave both files alone until they fix it.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/template"
+)
+
+const (
+	TEMPLATE_SUFFIX = OVERRIDE_SEP + "template"
+
+	// Under .git. What we last rendered for each template, to spot local edits
+	RENDERED_DIR = "loftus/rendered"
+)
+
+// Custom template variables, from --var name=value
+type TemplateVars map[string]string
+
+func (self TemplateVars) String() string {
+	var pairs []string
+	for name, value := range self {
+		pairs = append(pairs, name+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (self TemplateVars) Set(pair string) error {
+	pairParts := strings.SplitN(pair, "=", 2)
+	if len(pairParts) != 2 {
+		return errors.New("Variables must be name=value, not: " + pair)
+	}
+	self[pairParts[0]] = pairParts[1]
+	return nil
+}
+
+// What templates can refer to
+type TemplateData struct {
+	Host string
+	User string
+	OS   string
+	Home string
+	Var  TemplateVars
+}
+
+// Render every template, or copy edits to the rendered file back to it's template.
+// templates are from findGenerated. Returns the rendered names, relative to rootDir.
+func (self *GitBackend) applyTemplates(templates []string) []string {
+
+	var rendered []string
+	for _, tmplName := range templates {
+
+		canonical := strings.TrimSuffix(tmplName, TEMPLATE_SUFFIX)
+		rendered = append(rendered, canonical)
+
+		err := self.syncTemplate(tmplName, canonical)
+		if err != nil {
+			log.Println("Template", tmplName, err)
+		}
+	}
+
+	return rendered
+}
+
+// Bring a template and it's rendered file in line with each other
+func (self *GitBackend) syncTemplate(tmplName string, canonical string) error {
+
+	tmplPath := filepath.Join(self.rootDir, tmplName)
+	path := filepath.Join(self.rootDir, canonical)
+	statePath := filepath.Join(self.rootDir, ".git", RENDERED_DIR, canonical)
+	conflictPath := statePath + ".conflict"
+
+	info, err := os.Stat(tmplPath)
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := os.ReadFile(tmplPath)
+	if err != nil {
+		return err
+	}
+
+	rendered, err := self.render(string(tmpl))
+	if err != nil {
+		return err
+	}
+
+	last, lastErr := os.ReadFile(statePath)
+	current, currentErr := os.ReadFile(path)
+
+	switch {
+
+	// Not rendered yet, or the user deleted it to get a fresh copy
+	case os.IsNotExist(currentErr):
+		err = os.WriteFile(path, []byte(rendered), info.Mode())
+
+	// Up to date
+	case string(current) == rendered:
+		err = nil
+
+	// No local edits, so the template changed
+	case lastErr == nil && bytes.Equal(current, last):
+		log.Println("Rendering", tmplName)
+		err = os.WriteFile(path, []byte(rendered), info.Mode())
+
+	// Local edit. Only safe to map back if template is what we rendered last time.
+	default:
+		newTmpl := ""
+		if lastErr == nil && string(last) == rendered {
+			newTmpl, err = self.unrender(string(tmpl), string(current))
+		} else {
+			err = errors.New("template and rendered file both changed")
+		}
+
+		if err != nil {
+			return self.templateConflict(canonical, conflictPath, current, err)
+		}
+
+		log.Println("Copying edits to", canonical, "back to", tmplName)
+		err = os.WriteFile(tmplPath, []byte(newTmpl), info.Mode())
+		rendered = string(current)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	os.Remove(conflictPath)
+	err = os.MkdirAll(filepath.Dir(statePath), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(statePath, []byte(rendered), 0644)
+}
+
+// Alert the user, once for each version of the rendered file
+func (self *GitBackend) templateConflict(canonical string, conflictPath string, current []byte, cause error) error {
+
+	previous, _ := os.ReadFile(conflictPath)
+	if bytes.Equal(previous, current) {
+		return nil
+	}
+
+	msg := "Cannot copy edits to " + canonical + " back to it's template: " + cause.Error() + ". " +
+		"Edit " + canonical + TEMPLATE_SUFFIX + " instead, or delete " + canonical + " to re-render it."
+	self.external.Exec("", CMD_ALERT, msg)
+
+	err := os.MkdirAll(filepath.Dir(conflictPath), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(conflictPath, current, 0644)
+}
+
+// Execute a template for this machine
+func (self *GitBackend) render(tmpl string) (string, error) {
+
+	parsed, err := template.New("").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+
+	data := TemplateData{
+		Host: self.hostName,
+		User: self.userName,
+		OS:   runtime.GOOS,
+		Home: os.Getenv("HOME"),
+		Var:  self.vars,
+	}
+
+	var out bytes.Buffer
+	err = parsed.Execute(&out, data)
+	return out.String(), err
+}
+
+// Work out the template which renders as 'edited', given it's current template.
+// Only possible if every template line renders to exactly one line, and
+// edits don't touch lines with markers.
+func (self *GitBackend) unrender(tmpl string, edited string) (string, error) {
+
+	tmplLines := strings.Split(tmpl, "\n")
+	editedLines := strings.Split(edited, "\n")
+
+	renderedLines := make([]string, len(tmplLines))
+	for index, line := range tmplLines {
+		renderedLine, err := self.render(line)
+		if err != nil || strings.Contains(renderedLine, "\n") {
+			return "", errors.New("template markers span several lines")
+		}
+		renderedLines[index] = renderedLine
+	}
+
+	var newLines []string
+	isTemplatedRemoved := false
+
+	for _, op := range diffLines(renderedLines, editedLines) {
+		switch {
+		case op.old != -1 && op.new != -1:
+			newLines = append(newLines, tmplLines[op.old])
+			isTemplatedRemoved = false
+
+		case op.old != -1:
+			isTemplatedRemoved = isTemplatedRemoved || tmplLines[op.old] != renderedLines[op.old]
+
+		default:
+			line := editedLines[op.new]
+			if isTemplatedRemoved {
+				return "", errors.New("a line with template markers was changed")
+			}
+			if strings.Contains(line, "{{") {
+				return "", errors.New("new line looks like a template marker")
+			}
+			newLines = append(newLines, line)
+		}
+	}
+
+	newTmpl := strings.Join(newLines, "\n")
+
+	check, err := self.render(newTmpl)
+	if err != nil || check != edited {
+		return "", errors.New("could not rebuild template")
+	}
+	return newTmpl, nil
+}
+
+// One step turning a into b: a line kept (both set), removed (new is -1) or added (old is -1)
+type lineOp struct {
+	old int
+	new int
+}
+
+// Longest common subsequence diff of two lists of lines.
+// Removals come before additions at the same place.
+func diffLines(a []string, b []string) []lineOp {
+
+	// lcs[i][j] is the length of the common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var ops []lineOp
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, lineOp{i, j})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, lineOp{i, -1})
+			i++
+		default:
+			ops = append(ops, lineOp{-1, j})
+			j++
+		}
+	}
+	return ops
+}
@@ -0,0 +1,210 @@
+// Optional TLS for the connection between clients and server.
+//
+// The server uses --tls-cert and --tls-key if given, otherwise a self-signed
+// certificate it creates on first run. Clients verify the server against
+// --tls-ca if given, otherwise they pin the server's certificate the first
+// time they connect (trust on first use), and refuse to connect if it changes.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	TLS_DIR           = ".config/loftus" // In $HOME
+	TLS_CERT_NAME     = "server.crt"
+	TLS_KEY_NAME      = "server.key"
+	KNOWN_SERVERS     = "known_servers"
+	SELF_SIGNED_YEARS = 10
+)
+
+// Server side TLS configuration. nil without --tls.
+func serverTlsConfig(config *Config) (*tls.Config, error) {
+
+	if !config.isTls {
+		return nil, nil
+	}
+
+	certFile, keyFile := config.tlsCert, config.tlsKey
+	if len(certFile) == 0 || len(keyFile) == 0 {
+		dir := filepath.Join(os.Getenv("HOME"), TLS_DIR)
+		certFile = filepath.Join(dir, TLS_CERT_NAME)
+		keyFile = filepath.Join(dir, TLS_KEY_NAME)
+
+		_, err := os.Stat(certFile)
+		if os.IsNotExist(err) {
+			log.Println("Creating self-signed certificate", certFile)
+			err = makeSelfSigned(config.serverAddr, certFile, keyFile)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("TLS certificate fingerprint", fingerprint(cert.Certificate[0]))
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12}, nil
+}
+
+// Client side TLS configuration, for the server at serverAddr. It may be
+// configured, or found with mDNS, so the pin is kept per address.
+func clientTlsConfig(config *Config, serverAddr string) (*tls.Config, error) {
+
+	host, _, err := net.SplitHostPort(serverAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(config.tlsCa) != 0 {
+		caPem, err := os.ReadFile(config.tlsCa)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return nil, errors.New("No certificates found in " + config.tlsCa)
+		}
+		return &tls.Config{RootCAs: pool, ServerName: host, MinVersion: tls.VersionTLS12}, nil
+	}
+
+	knownFile := filepath.Join(os.Getenv("HOME"), TLS_DIR, KNOWN_SERVERS)
+	return &tls.Config{
+		// Self-signed, so the usual verification would fail. We check the pin instead.
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("Server sent no certificate")
+			}
+			return checkPin(knownFile, serverAddr, fingerprint(state.PeerCertificates[0].Raw))
+		}}, nil
+}
+
+// Connect to the server, with TLS if tlsConf isn't nil
+func dialServer(serverAddr string, tlsConf *tls.Config) (net.Conn, error) {
+	if tlsConf == nil {
+		return net.Dial("tcp", serverAddr)
+	}
+	dialer := &net.Dialer{Timeout: HANDSHAKE_SECS * time.Second}
+	return tls.DialWithDialer(dialer, "tcp", serverAddr, tlsConf)
+}
+
+// Trust on first use. Remember the fingerprint the first time we see
+// a server, and reject any other fingerprint for it after that.
+// Delete the server's line in knownFile if it's certificate really did change.
+func checkPin(knownFile string, serverAddr string, print string) error {
+
+	content, err := os.ReadFile(knownFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != serverAddr {
+			continue
+		}
+		if fields[1] != print {
+			return errors.New("Certificate for " + serverAddr + " changed! Pinned " + fields[1] +
+				", got " + print + ". If you expected this, remove it from " + knownFile)
+		}
+		return nil
+	}
+
+	log.Println("Pinning certificate for", serverAddr, print)
+
+	err = os.MkdirAll(filepath.Dir(knownFile), 0700)
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(knownFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = out.WriteString(serverAddr + " " + print + "\n")
+	closeErr := out.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// SHA-256 of a DER certificate, in hex
+func fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// Create a key and self-signed certificate for the host in serverAddr
+func makeSelfSigned(serverAddr string, certFile string, keyFile string) error {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	host, _, err := net.SplitHostPort(serverAddr)
+	if err != nil || len(host) == 0 {
+		host, _ = os.Hostname()
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(SELF_SIGNED_YEARS, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(certFile), 0700)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}